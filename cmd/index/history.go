@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+var audit = flag.String("audit", "", "instead of indexing, print the accounts this authorized_keys line was seen on, and when")
+
+// key_userid rows hold the current range in which a key was seen on an
+// account. When a -snapshot stops seeing it there, the range is moved to
+// key_history, and a new range starts if it's seen again.
+const historyQuery = "CREATE TABLE IF NOT EXISTS key_history (keyHash BLOB, source TEXT, userID INTEGER, kind TEXT, firstSeen INTEGER, lastSeen INTEGER, PRIMARY KEY (keyHash, source, userID, kind, firstSeen)) WITHOUT ROWID;" // firstSeen and lastSeen are UNIX timestamps, zero if unknown
+
+// printAudit prints every range in which key was seen on an account, in
+// chronological order, which shows when it changed hands.
+func printAudit(conn *sqlite.Conn, key string) error {
+	keyHash, err := canonicalKeyHash(key)
+	if err != nil {
+		return err
+	}
+	var n int
+	err = sqlitex.Exec(conn, `SELECT source, userID, kind, firstSeen, lastSeen, current, login FROM (
+			SELECT source, userID, kind, firstSeen, lastSeen, 1 AS current FROM key_userid WHERE keyHash = $1
+			UNION ALL
+			SELECT source, userID, kind, firstSeen, lastSeen, 0 AS current FROM key_history WHERE keyHash = $1
+		) LEFT JOIN users USING (source, userID) ORDER BY firstSeen, lastSeen, source, userID, kind;`,
+		func(stmt *sqlite.Stmt) error {
+			n++
+			account := fmt.Sprintf("%s user %d", stmt.GetText("source"), stmt.GetInt64("userID"))
+			if login := stmt.GetText("login"); login != "" {
+				account += " (@" + login + ")"
+			}
+			until := formatSeen(stmt.GetInt64("lastSeen"))
+			if stmt.GetInt64("current") == 1 {
+				until += " (current)"
+			}
+			fmt.Fprintf(os.Stdout, "%s: %s key, seen from %s to %s\n", account, stmt.GetText("kind"),
+				formatSeen(stmt.GetInt64("firstSeen")), until)
+			return nil
+		}, keyHash)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Fprintln(os.Stdout, "Key never seen.")
+	}
+	return nil
+}
+
+func formatSeen(t int64) string {
+	if t == 0 {
+		return "unknown"
+	}
+	return time.Unix(t, 0).UTC().Format("2006-01-02")
+}
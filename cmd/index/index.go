@@ -1,64 +1,354 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
 )
 
+var rejectsPath = flag.String("rejects", "", "write records with unparseable keys to this JSONL file")
+var batchSize = flag.Int("batch", 100000, "number of records inserted per transaction")
+var crawledFrom = flag.String("crawled-from", "", "start of the crawls in the input as an RFC 3339 time, recorded in the metadata")
+var crawledUntil = flag.String("crawled-until", "", "end of the crawls in the input as an RFC 3339 time, recorded in the metadata")
+
+// progressEvery is how often loading progress is logged, in records.
+const progressEvery = 1000000
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: index [-snapshot] [-rejects FILE] [-batch N] [-crawled-from TIME] [-crawled-until TIME] DB_PATH [INPUT...]\n")
+		fmt.Fprintf(os.Stderr, "       index -audit AUTHORIZED_KEY DB_PATH\n")
+		fmt.Fprintf(os.Stderr, "INPUT files are JSONL from cmd/refresh, optionally gzip or zstd compressed.\n")
+		fmt.Fprintf(os.Stderr, "The default, or \"-\", is standard input.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *batchSize <= 0 {
+		log.Fatal("-batch must be positive")
+	}
+	if *audit != "" {
+		// The database might be the one being served, so leave it be.
+		conn, err := sqlite.OpenConn(flag.Arg(0), sqlite.SQLITE_OPEN_READONLY|sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		if err := printAudit(conn, *audit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	inputs := flag.Args()[1:]
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	x := &indexer{now: time.Now().Unix()}
+	if *rejectsPath != "" {
+		f, err := os.Create(*rejectsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		x.rejects = json.NewEncoder(f)
+	}
+
 	log.Println("Opening database...")
-	conn, err := sqlite.OpenConn(os.Args[1], 0)
+	conn, err := sqlite.OpenConn(flag.Arg(0), 0)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
+	x.conn = conn
+
+	// A crashed build can be restarted, so trade durability for speed. WAL
+	// keeps the file consistent even if the last transactions are lost.
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = WAL;",
+		"PRAGMA synchronous = OFF;",
+		"PRAGMA cache_size = -1048576;", // 1 GiB
+		"PRAGMA temp_store = FILE;",
+	} {
+		if err := sqlitex.ExecTransient(conn, pragma, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	createQuery := "CREATE TABLE IF NOT EXISTS key_userid (keyHash BLOB PRIMARY KEY, userID INTEGER) WITHOUT ROWID;" // keyHash is SHA-256(key)[:16]
 	if _, err := conn.Prep(createQuery).Step(); err != nil {
 		log.Fatal(err)
 	}
+	if _, err := conn.Prep(historyQuery).Step(); err != nil {
+		log.Fatal(err)
+	}
 
-	insStmt, err := conn.Prepare("INSERT INTO key_userid (keyHash, userID) VALUES ($1, $2);")
+	md, err := keydb.ReadMetadata(conn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if md.SchemaVersion > keydb.SchemaVersion || md.HashScheme != "" && md.HashScheme != keydb.HashScheme {
+		log.Fatalf("database was built by a newer or incompatible version: %v", md.Check())
+	}
+	if md.SchemaVersion == 0 && x.count("SELECT COUNT(*) FROM key_userid;") > 0 {
+		log.Fatal("database predates metadata, and might have keys hashed without canonicalization or an older schema: rebuild it from scratch")
+	}
+	if err := setCrawlRange(md); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := conn.Prep(keydb.MetadataQuery).Step(); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Println("Inserting keys...")
-	d := json.NewDecoder(os.Stdin)
-	for {
-		var line struct {
-			ID  int64  `json:"id"`
-			Key string `json:"key"`
-		}
-		if err := d.Decode(&line); err == io.EOF {
-			break
-		} else if err != nil {
+	if _, err := conn.Prep(usersQuery).Step(); err != nil {
+		log.Fatal(err)
+	}
+	if err := sqlitex.ExecTransient(conn, stagingQuery, nil); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := x.prepare(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Loading keys...")
+	x.began = time.Now()
+	x.exec("BEGIN;")
+	for _, path := range inputs {
+		in, err := openInput(path)
+		if err != nil {
 			log.Fatal(err)
 		}
-		keyHash := sha256.Sum256([]byte(line.Key))
-
-		if err := insStmt.Reset(); err != nil {
+		x.load(in)
+		if err := in.Close(); err != nil {
 			log.Fatal(err)
 		}
-		insStmt.SetBytes("$1", keyHash[:16])
-		insStmt.SetInt64("$2", line.ID)
-		_, err = insStmt.Step()
-		if err, ok := err.(sqlite.Error); ok && err.Code == sqlite.SQLITE_CONSTRAINT_PRIMARYKEY {
-			// Key already in the database.
+	}
+	x.exec("COMMIT;")
+	log.Printf("Loaded %d records, rejected %d with unparseable keys, in %v",
+		x.records, x.rejected, time.Since(x.began).Round(time.Second))
+
+	log.Println("Sorting and inserting keys...")
+	x.exec("BEGIN;")
+	if *snapshot {
+		added, moved, removed := x.applySnapshot()
+		log.Printf("Applied snapshot: %d keys added, %d moved, %d removed", added, moved, removed)
+	} else {
+		x.exec(`CREATE TEMP TABLE added AS
+			SELECT keyHash, source, userID, kind FROM staging
+			EXCEPT SELECT keyHash, source, userID, kind FROM key_userid;`)
+		log.Printf("Indexed %d new keys", x.count("SELECT COUNT(*) FROM added;"))
+		x.exec("DROP TABLE added;")
+		x.upsertStaging()
+	}
+	x.exec("DROP TABLE staging;")
+	md.SchemaVersion, md.HashScheme = keydb.SchemaVersion, keydb.HashScheme
+	md.BuildTime = time.Unix(x.now, 0)
+	md.Keys = x.count("SELECT COUNT(*) FROM key_userid;")
+	md.Users = x.count("SELECT COUNT(*) FROM users;")
+	md.HistoryRanges = x.count("SELECT COUNT(*) FROM key_history;")
+	if err := keydb.WriteMetadata(conn, md); err != nil {
+		log.Fatal(err)
+	}
+	x.exec("COMMIT;")
+	log.Printf("Done in %v", time.Since(x.began).Round(time.Second))
+
+	log.Println("Closing database...")
+	x.exec("PRAGMA journal_mode = DELETE;") // a single self-contained file
+	if _, err := conn.Prep("VACUUM;").Step(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+const createQuery = "CREATE TABLE IF NOT EXISTS key_userid (keyHash BLOB, source TEXT, userID INTEGER, kind TEXT, firstSeen INTEGER NOT NULL DEFAULT 0, lastSeen INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (keyHash, source, userID, kind)) WITHOUT ROWID;" // keyHash is SHA-256(canonical key)[:16], kind is authentication or signing, firstSeen and lastSeen are UNIX timestamps
+
+const usersQuery = "CREATE TABLE IF NOT EXISTS users (source TEXT, userID INTEGER, login TEXT, name TEXT, updated INTEGER, PRIMARY KEY (source, userID));" // updated is a UNIX timestamp
+
+// Keys are first appended to an unindexed staging table, and then inserted
+// sorted by keyHash, so that the B-tree is built sequentially.
+const stagingQuery = "CREATE TEMP TABLE staging (keyHash BLOB, source TEXT, userID INTEGER, kind TEXT);"
+
+// indexer loads records into the staging table, in transactions of
+// *batchSize records.
+type indexer struct {
+	conn                *sqlite.Conn
+	stageStmt, userStmt *sqlite.Stmt
+	rejects             *json.Encoder
+	now                 int64
+
+	lastSource        string
+	lastUser          int64
+	records, rejected int
+	began             time.Time
+}
+
+// prepare prepares the statements used by load. The staging table must exist.
+func (x *indexer) prepare() error {
+	var err error
+	x.stageStmt, err = x.conn.Prepare("INSERT INTO staging (keyHash, source, userID, kind) VALUES ($1, $2, $3, $4);")
+	if err != nil {
+		return err
+	}
+	x.userStmt, err = x.conn.Prepare(`INSERT INTO users (source, userID, login, name, updated) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (source, userID) DO UPDATE SET login = excluded.login, name = excluded.name, updated = excluded.updated;`)
+	return err
+}
+
+// upsertStaging inserts the staged keys, sorted by keyHash, starting a new
+// range for new ones and extending the current range of the others. Keys in
+// the first crawl of a source might have been there for years, so the ranges
+// they start have an unknown (zero) firstSeen.
+func (x *indexer) upsertStaging() {
+	x.exec(`CREATE TEMP TABLE known_sources AS
+		SELECT source FROM (SELECT DISTINCT source FROM staging) AS s
+		WHERE EXISTS (SELECT 1 FROM key_userid WHERE key_userid.source = s.source)
+		OR EXISTS (SELECT 1 FROM key_history WHERE key_history.source = s.source);`)
+	x.exec(fmt.Sprintf(`INSERT INTO key_userid (keyHash, source, userID, kind, firstSeen, lastSeen)
+		SELECT keyHash, source, userID, kind, CASE WHEN source IN known_sources THEN %[1]d ELSE 0 END, %[1]d
+		FROM staging WHERE true
+		ORDER BY keyHash, source, userID, kind
+		ON CONFLICT (keyHash, source, userID, kind) DO UPDATE SET lastSeen = excluded.lastSeen;`, x.now))
+	x.exec("DROP TABLE known_sources;")
+}
+
+// setCrawlRange updates the crawl range of md from the flags, if set.
+func setCrawlRange(md *keydb.Metadata) error {
+	for _, f := range []struct {
+		value string
+		t     *time.Time
+	}{{*crawledFrom, &md.CrawledFrom}, {*crawledUntil, &md.CrawledUntil}} {
+		if f.value == "" {
 			continue
 		}
+		t, err := time.Parse(time.RFC3339, f.value)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		*f.t = t
 	}
+	return nil
+}
 
-	log.Println("Closing database...")
-	if _, err := conn.Prep("VACUUM;").Step(); err != nil {
+func (x *indexer) exec(query string) {
+	if err := sqlitex.ExecTransient(x.conn, query, nil); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func (x *indexer) load(in *input) {
+	d := json.NewDecoder(in)
+	for {
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("%s: %v", in.name, err)
+		}
+		var line struct {
+			Source string `json:"source"`
+			ID     int64  `json:"id"`
+			Key    string `json:"key"`
+			Kind   string `json:"kind"`
+			Login  string `json:"login"`
+			Name   string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &line); err != nil {
+			log.Fatalf("%s: %v", in.name, err)
+		}
+		x.records++
+		if x.records%*batchSize == 0 {
+			x.exec("COMMIT;")
+			x.exec("BEGIN;")
+		}
+		if x.records%progressEvery == 0 {
+			x.logProgress(in)
+		}
+		if line.Source == "" {
+			line.Source = "github" // predates multiple sources
+		}
+		if line.Kind == "" {
+			line.Kind = "authentication" // predates signing keys
+		}
+		keyHash, err := canonicalKeyHash(line.Key)
+		if err != nil {
+			x.rejected++
+			if x.rejects != nil {
+				if err := x.rejects.Encode(struct {
+					Error  string          `json:"error"`
+					Record json.RawMessage `json:"record"`
+				}{err.Error(), raw}); err != nil {
+					log.Fatal(err)
+				}
+			}
+			continue
+		}
+
+		if line.Login != "" && (line.ID != x.lastUser || line.Source != x.lastSource) {
+			x.lastSource, x.lastUser = line.Source, line.ID
+			if err := x.userStmt.Reset(); err != nil {
+				log.Fatal(err)
+			}
+			x.userStmt.SetText("$1", line.Source)
+			x.userStmt.SetInt64("$2", line.ID)
+			x.userStmt.SetText("$3", line.Login)
+			x.userStmt.SetText("$4", line.Name)
+			x.userStmt.SetInt64("$5", x.now)
+			if _, err := x.userStmt.Step(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := x.stageStmt.Reset(); err != nil {
+			log.Fatal(err)
+		}
+		x.stageStmt.SetBytes("$1", keyHash)
+		x.stageStmt.SetText("$2", line.Source)
+		x.stageStmt.SetInt64("$3", line.ID)
+		x.stageStmt.SetText("$4", line.Kind)
+		if _, err := x.stageStmt.Step(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (x *indexer) logProgress(in *input) {
+	elapsed := time.Since(x.began)
+	rate := float64(x.records) / elapsed.Seconds()
+	if in.size > 0 {
+		log.Printf("%d records (%.0f/s), %s %.1f%%", x.records, rate,
+			in.name, float64(in.progress())*100/float64(in.size))
+	} else {
+		log.Printf("%d records (%.0f/s), %s", x.records, rate, in.name)
+	}
+}
+
+// canonicalKeyHash parses an authorized_keys line, and hashes it like the
+// server does, in canonical form: without options, comment, or extra
+// whitespace, and with a normalized encoding.
+func canonicalKeyHash(key string) ([]byte, error) {
+	pk, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("more than one key")
+	}
+	return keydb.KeyHash(pk), nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
+)
+
+func TestCanonicalKeyHash(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []interface{}{edPub, &rsaKey.PublicKey} {
+		pk, err := ssh.NewPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+		typ, b64, _ := strings.Cut(line, " ")
+		want := keydb.KeyHash(pk)
+		for _, key := range []string{
+			line,
+			line + "\n",
+			line + " alice@example.com",
+			line + " a comment with spaces",
+			"  " + typ + "   " + b64 + "  \t",
+			typ + "\t" + b64 + "\tcomment\r\n",
+			`no-pty,command="echo hi" ` + line + " comment",
+			`from="10.0.0.0/8",no-agent-forwarding ` + line,
+		} {
+			got, err := canonicalKeyHash(key)
+			if err != nil {
+				t.Errorf("canonicalKeyHash(%q): %v", key, err)
+			} else if !bytes.Equal(got, want) {
+				t.Errorf("canonicalKeyHash(%q) = %x, want %x", key, got, want)
+			}
+		}
+
+		for _, key := range []string{
+			"",
+			typ,
+			typ + " not-base64",
+			line + "\n" + line,
+		} {
+			if got, err := canonicalKeyHash(key); err == nil {
+				t.Errorf("canonicalKeyHash(%q) = %x, want error", key, got)
+			}
+		}
+	}
+}
+
+// newTestIndexer returns an indexer on an empty in-memory database.
+func newTestIndexer(t *testing.T) *indexer {
+	t.Helper()
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	x := &indexer{conn: conn}
+	for _, q := range []string{createQuery, historyQuery, usersQuery, stagingQuery} {
+		x.exec(q)
+	}
+	if err := x.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	x.exec("DROP TABLE staging;")
+	return x
+}
+
+type testRecord struct {
+	Source string `json:"source"`
+	ID     int64  `json:"id"`
+	Key    string `json:"key"`
+	Kind   string `json:"kind,omitempty"`
+}
+
+// index loads records as if they were crawled at now, like main does, and
+// returns the counts of applySnapshot if snapshot is set.
+func (x *indexer) index(t *testing.T, now int64, snapshot bool, records ...testRecord) (added, moved, removed int64) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	for _, r := range records {
+		if err := json.NewEncoder(buf).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	x.now = now
+	x.exec(stagingQuery)
+	x.exec("BEGIN;")
+	x.load(&input{Reader: buf, name: "test"})
+	x.exec("COMMIT;")
+	x.exec("BEGIN;")
+	if snapshot {
+		added, moved, removed = x.applySnapshot()
+	} else {
+		x.upsertStaging()
+	}
+	x.exec("DROP TABLE staging;")
+	x.exec("COMMIT;")
+	return added, moved, removed
+}
+
+// owners returns the accounts key is currently registered on.
+func (x *indexer) owners(t *testing.T, key string) []testRecord {
+	t.Helper()
+	keyHash, err := canonicalKeyHash(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners []testRecord
+	err = sqlitex.Exec(x.conn, "SELECT source, userID, kind FROM key_userid WHERE keyHash = ? ORDER BY source, userID, kind;",
+		func(stmt *sqlite.Stmt) error {
+			owners = append(owners, testRecord{Source: stmt.GetText("source"), ID: stmt.GetInt64("userID"),
+				Key: key, Kind: stmt.GetText("kind")})
+			return nil
+		}, keyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return owners
+}
+
+func newTestKeys(t *testing.T, n int) []string {
+	t.Helper()
+	var keys []string
+	for i := 0; i < n; i++ {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))))
+	}
+	return keys
+}
+
+func TestApplySnapshot(t *testing.T) {
+	x := newTestIndexer(t)
+	k := newTestKeys(t, 6)
+
+	added, moved, removed := x.index(t, 1000, true,
+		testRecord{Source: "github", ID: 1, Key: k[0]},
+		testRecord{Source: "github", ID: 2, Key: k[1]},
+		testRecord{Source: "github", ID: 3, Key: k[2]},
+		testRecord{Source: "gitlab", ID: 5, Key: k[3]},
+		testRecord{Source: "github", ID: 6, Key: k[5]},
+	)
+	if added != 5 || moved != 0 || removed != 0 {
+		t.Errorf("first snapshot: %d added, %d moved, %d removed; want 5, 0, 0", added, moved, removed)
+	}
+
+	// A new snapshot of GitHub only: k[1] changes owner, k[5] changes kind,
+	// k[2] is gone, and k[4] is new. GitLab is not part of it.
+	added, moved, removed = x.index(t, 2000, true,
+		testRecord{Source: "github", ID: 1, Key: k[0]},
+		testRecord{Source: "github", ID: 9, Key: k[1]},
+		testRecord{Source: "github", ID: 4, Key: k[4]},
+		testRecord{Source: "github", ID: 6, Key: k[5], Kind: "signing"},
+	)
+	if added != 1 || moved != 2 || removed != 1 {
+		t.Errorf("second snapshot: %d added, %d moved, %d removed; want 1, 2, 1", added, moved, removed)
+	}
+	for i, want := range [][]testRecord{
+		{{Source: "github", ID: 1, Kind: "authentication"}},
+		{{Source: "github", ID: 9, Kind: "authentication"}},
+		nil,
+		{{Source: "gitlab", ID: 5, Kind: "authentication"}},
+		{{Source: "github", ID: 4, Kind: "authentication"}},
+		{{Source: "github", ID: 6, Kind: "signing"}},
+	} {
+		got := x.owners(t, k[i])
+		for j := range want {
+			want[j].Key = k[i]
+		}
+		if len(got) != len(want) || len(got) > 0 && got[0] != want[0] {
+			t.Errorf("key %d is on %+v, want %+v", i, got, want)
+		}
+	}
+
+	// Without -snapshot, keys are only ever added.
+	x.index(t, 3000, false, testRecord{Source: "github", ID: 7, Key: k[0]})
+	if got := x.owners(t, k[0]); len(got) != 2 {
+		t.Errorf("key 0 is on %+v, want two accounts", got)
+	}
+}
+
+type seenRange struct{ firstSeen, lastSeen int64 }
+
+// ranges returns the current and past ranges of key on an account.
+func (x *indexer) ranges(t *testing.T, key, source string, userID int64) (current *seenRange, history []seenRange) {
+	t.Helper()
+	keyHash, err := canonicalKeyHash(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.Exec(x.conn, "SELECT firstSeen, lastSeen FROM key_userid WHERE keyHash = ? AND source = ? AND userID = ?;",
+		func(stmt *sqlite.Stmt) error {
+			current = &seenRange{stmt.GetInt64("firstSeen"), stmt.GetInt64("lastSeen")}
+			return nil
+		}, keyHash, source, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.Exec(x.conn, "SELECT firstSeen, lastSeen FROM key_history WHERE keyHash = ? AND source = ? AND userID = ? ORDER BY firstSeen;",
+		func(stmt *sqlite.Stmt) error {
+			history = append(history, seenRange{stmt.GetInt64("firstSeen"), stmt.GetInt64("lastSeen")})
+			return nil
+		}, keyHash, source, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return current, history
+}
+
+func TestHistory(t *testing.T) {
+	x := newTestIndexer(t)
+	k := newTestKeys(t, 4)
+	check := func(key string, userID int64, current *seenRange, history ...seenRange) {
+		t.Helper()
+		gotCurrent, gotHistory := x.ranges(t, key, "github", userID)
+		if (gotCurrent == nil) != (current == nil) || current != nil && *gotCurrent != *current {
+			t.Errorf("current range of user %d is %v, want %v", userID, gotCurrent, current)
+		}
+		if len(gotHistory) != len(history) {
+			t.Errorf("past ranges of user %d are %v, want %v", userID, gotHistory, history)
+			return
+		}
+		for i := range history {
+			if gotHistory[i] != history[i] {
+				t.Errorf("past ranges of user %d are %v, want %v", userID, gotHistory, history)
+			}
+		}
+	}
+
+	// The first crawl of a source can't tell how long keys were there.
+	x.index(t, 1000, true,
+		testRecord{Source: "github", ID: 1, Key: k[0]},
+		testRecord{Source: "github", ID: 2, Key: k[1]},
+	)
+	check(k[0], 1, &seenRange{0, 1000})
+
+	x.index(t, 2000, true,
+		testRecord{Source: "github", ID: 2, Key: k[1]},
+		testRecord{Source: "github", ID: 3, Key: k[2]},
+	)
+	check(k[0], 1, nil, seenRange{0, 1000})
+	check(k[1], 2, &seenRange{0, 2000})
+	check(k[2], 3, &seenRange{2000, 2000})
+
+	// Seen again, on the same account and on a new one.
+	x.index(t, 3000, true,
+		testRecord{Source: "github", ID: 1, Key: k[0]},
+		testRecord{Source: "github", ID: 4, Key: k[0]},
+		testRecord{Source: "github", ID: 2, Key: k[1]},
+	)
+	check(k[0], 1, &seenRange{3000, 3000}, seenRange{0, 1000})
+	check(k[0], 4, &seenRange{3000, 3000})
+	check(k[1], 2, &seenRange{0, 3000})
+	check(k[2], 3, nil, seenRange{2000, 2000})
+
+	x.index(t, 4000, true, testRecord{Source: "github", ID: 2, Key: k[1]})
+	check(k[0], 1, nil, seenRange{0, 1000}, seenRange{3000, 3000})
+
+	// Incremental loads extend ranges, but never end them.
+	x.index(t, 5000, false, testRecord{Source: "github", ID: 2, Key: k[3]})
+	check(k[1], 2, &seenRange{0, 4000})
+	check(k[3], 2, &seenRange{5000, 5000})
+}
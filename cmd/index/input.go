@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// input is a JSONL input file, transparently decompressed if it's gzip or
+// zstd compressed.
+type input struct {
+	io.Reader
+	name string
+	size int64 // of the file on disk, or zero if unknown
+	read countingReader
+	f    *os.File
+	zr   io.Closer
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openInput opens the file at path, or stdin if path is "-".
+func openInput(path string) (*input, error) {
+	in := &input{name: path, f: os.Stdin}
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		in.f = f
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			in.size = fi.Size()
+		}
+	}
+	in.read.r = in.f
+	br := bufio.NewReaderSize(&in.read, 1<<20)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		in.Reader, in.zr = zr, zr
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		in.Reader, in.zr = zr, zr.IOReadCloser()
+	default:
+		in.Reader = br
+	}
+	return in, nil
+}
+
+// progress returns how many bytes of the file on disk were read.
+func (in *input) progress() int64 {
+	return in.read.n
+}
+
+func (in *input) Close() error {
+	if in.zr != nil {
+		in.zr.Close()
+	}
+	if in.f == os.Stdin {
+		return nil
+	}
+	return in.f.Close()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestLoadInputs(t *testing.T) {
+	oldBatch := *batchSize
+	*batchSize = 3 // commit in the middle of each file
+	t.Cleanup(func() { *batchSize = oldBatch })
+
+	plain := &bytes.Buffer{}
+	for i, k := range newTestKeys(t, 10) {
+		if err := json.NewEncoder(plain).Encode(testRecord{Source: "github", ID: int64(i), Key: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain.WriteString(`{"source":"github","id":99,"key":"ssh-ed25519 not-a-key"}` + "\n")
+	const records, rejected = 11, 1
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gz := &bytes.Buffer{}
+	gw := gzip.NewWriter(gz)
+	gw.Write(plain.Bytes())
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll(plain.Bytes(), nil)
+	paths := []string{
+		write("keys.jsonl", plain.Bytes()),
+		write("keys.jsonl.gz", gz.Bytes()),
+		write("keys.jsonl.zst", zst),
+		"-",
+	}
+
+	// "-" is stdin, which can be compressed too.
+	stdin, err := os.Open(write("stdin", gz.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = oldStdin })
+
+	x := newTestIndexer(t)
+	x.exec(stagingQuery)
+	x.exec("BEGIN;")
+	for i, path := range paths {
+		in, err := openInput(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		x.load(in)
+		if path != "-" {
+			if fi, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			} else if in.size != fi.Size() || in.progress() != fi.Size() {
+				t.Errorf("%s: read %d of %d bytes, want %d", path, in.progress(), in.size, fi.Size())
+			}
+		}
+		if err := in.Close(); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if x.records != records*(i+1) || x.rejected != rejected*(i+1) {
+			t.Errorf("%s: %d records loaded and %d rejected in total, want %d and %d",
+				path, x.records, x.rejected, records*(i+1), rejected*(i+1))
+		}
+		if n := x.count("SELECT COUNT(*) FROM staging;"); n != int64((records-rejected)*(i+1)) {
+			t.Errorf("%s: %d rows staged in total, want %d", path, n, (records-rejected)*(i+1))
+		}
+	}
+	x.exec("COMMIT;")
+}
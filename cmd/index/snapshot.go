@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+var snapshot = flag.Bool("snapshot", false, "treat the input as a complete crawl of its sources: move keys to their new owners, and remove keys not seen again")
+
+// applySnapshot makes key_userid match the staging table for every source
+// present in it, moving the ranges of removed keys to key_history, and returns
+// how many keys were added, moved (changed owner or kind), and removed.
+// Sources absent from the snapshot are left untouched.
+func (x *indexer) applySnapshot() (added, moved, removed int64) {
+	x.exec("CREATE TEMP TABLE snapshot_sources AS SELECT DISTINCT source FROM staging;")
+	x.exec(`CREATE TEMP TABLE added AS
+		SELECT keyHash, source, userID, kind FROM staging
+		EXCEPT SELECT keyHash, source, userID, kind FROM key_userid;`)
+	x.exec(`CREATE TEMP TABLE removed AS
+		SELECT keyHash, source, userID, kind FROM key_userid WHERE source IN snapshot_sources
+		EXCEPT SELECT keyHash, source, userID, kind FROM staging;`)
+	x.exec("CREATE INDEX temp.staging_keyHash ON staging (keyHash);")
+
+	added = x.count(`SELECT COUNT(DISTINCT keyHash) FROM added
+		WHERE keyHash NOT IN (SELECT keyHash FROM key_userid);`)
+	removed = x.count(`SELECT COUNT(DISTINCT keyHash) FROM removed
+		WHERE keyHash NOT IN (SELECT keyHash FROM staging);`)
+	moved = x.count(`SELECT COUNT(*) FROM (SELECT keyHash FROM added UNION SELECT keyHash FROM removed)
+		WHERE keyHash IN (SELECT keyHash FROM key_userid) AND keyHash IN (SELECT keyHash FROM staging);`)
+
+	// The ranges of removed keys end when they were last seen.
+	x.exec(`INSERT OR REPLACE INTO key_history (keyHash, source, userID, kind, firstSeen, lastSeen)
+		SELECT keyHash, source, userID, kind, firstSeen, lastSeen FROM key_userid
+		WHERE (keyHash, source, userID, kind) IN (SELECT keyHash, source, userID, kind FROM removed);`)
+	x.exec(`DELETE FROM key_userid WHERE (keyHash, source, userID, kind) IN
+		(SELECT keyHash, source, userID, kind FROM removed);`)
+	x.upsertStaging()
+	x.exec("DROP TABLE snapshot_sources;")
+	x.exec("DROP TABLE added;")
+	x.exec("DROP TABLE removed;")
+
+	return added, moved, removed
+}
+
+// count runs a query returning a single integer.
+func (x *indexer) count(query string) int64 {
+	var n int64
+	err := sqlitex.ExecTransient(x.conn, query, func(stmt *sqlite.Stmt) error {
+		n = stmt.ColumnInt64(0)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var archivePath = flag.String("archive", "", "append every raw GitHub API response to this gzip-compressed JSONL file")
+var replayPath = flag.String("replay", "", "rebuild the output from an -archive file instead of crawling")
+
+// responseArchive is the -archive file, or nil.
+var responseArchive *archive
+
+// archiveEntry is a line of the archive. Body is the raw response to either
+// a GraphQL Query, or a REST URL listing the signing keys of User.
+type archiveEntry struct {
+	Time  time.Time       `json:"time"`
+	Query string          `json:"query,omitempty"`
+	URL   string          `json:"url,omitempty"`
+	User  *userNode       `json:"user,omitempty"`
+	Body  json.RawMessage `json:"body"`
+}
+
+type archive struct {
+	mu  sync.Mutex
+	f   *os.File
+	zw  *gzip.Writer
+	enc *json.Encoder
+}
+
+// openArchive opens an archive for appending. Each run adds a gzip member,
+// which readers decompress as a single stream.
+func openArchive(path string) (*archive, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(f)
+	return &archive{f: f, zw: zw, enc: json.NewEncoder(zw)}, nil
+}
+
+// write appends e to the archive, if a is not nil. Each entry is flushed, so
+// that an interrupted crawl loses at most the gzip trailer.
+func (a *archive) write(e archiveEntry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Time = time.Now()
+	if err := a.enc.Encode(e); err != nil {
+		log.Fatal(err)
+	}
+	if err := a.zw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (a *archive) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.zw.Close(); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+// replay emits the records found in every response of the archive at path.
+// Windows that were shrunk or overlapped are emitted more than once, which
+// cmd/index ignores.
+func replay(path string, out *output) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(zr)
+	var entries, records int
+	for {
+		var e archiveEntry
+		err := d.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Printf("Archive truncated after %d entries, probably by an interrupted crawl", entries)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rr, err := e.records()
+		if err != nil {
+			return err
+		}
+		out.write(rr)
+		entries++
+		records += len(rr)
+	}
+	log.Printf("Replayed %d responses, got %d keys", entries, records)
+	return nil
+}
+
+// records extracts the records of a response without any further request.
+func (e *archiveEntry) records() ([]record, error) {
+	if e.User != nil {
+		var keys []publicKey
+		if err := json.Unmarshal(e.Body, &keys); err != nil {
+			return nil, err
+		}
+		return e.User.keyRecords(keys, kindSigning), nil
+	}
+
+	var res struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(e.Body, &res); err != nil {
+		return nil, err
+	}
+	var users []*userNode
+	for name, data := range res.Data {
+		switch {
+		case name == "search":
+			var s searchResult
+			if err := json.Unmarshal(data, &s); err != nil {
+				return nil, err
+			}
+			for i := range s.Edges {
+				users = append(users, &s.Edges[i].Node)
+			}
+		case name == "nodes":
+			var nodes []*userNode
+			if err := json.Unmarshal(data, &nodes); err != nil {
+				return nil, err
+			}
+			users = append(users, nodes...)
+		case name == "node" || strings.HasPrefix(name, "u"):
+			var u *userNode
+			if err := json.Unmarshal(data, &u); err != nil {
+				return nil, err
+			}
+			users = append(users, u)
+		}
+	}
+	var records []record
+	for _, u := range users {
+		if u == nil || u.DatabaseID == 0 {
+			continue
+		}
+		records = append(records, u.keyRecords(u.PublicKeys.Nodes, kindAuthentication)...)
+	}
+	return records, nil
+}
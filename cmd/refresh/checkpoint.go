@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var checkpointPath = flag.String("checkpoint", "", "file to record progress in after each completed window or page")
+var resume = flag.Bool("resume", false, "continue from the -checkpoint file instead of START_TIME")
+
+// checkpoint is the progress of a crawl, saved after each completed unit of
+// work, so that a resumed crawl neither repeats nor skips any of it.
+type checkpoint struct {
+	mu sync.Mutex
+
+	Source string
+
+	// Partitions are the GitHub time ranges crawled in parallel.
+	Partitions []*partition `json:",omitempty"`
+
+	// Cursor is the next page of the GitLab or Gitea user listing, or the
+	// last listed ID of a GitHub crawl by ID.
+	Cursor string `json:",omitempty"`
+
+	// Complete is set when the GitLab user listing reached its last page,
+	// which leaves no Cursor to resume from.
+	Complete bool `json:",omitempty"`
+}
+
+type partition struct {
+	// Start is the beginning of the partition.
+	Start time.Time
+
+	// End is the end of the last completed search window, and Window is
+	// the size of the next one.
+	End    time.Time
+	Window time.Duration
+
+	// Until is the end of the partition. Zero means the present.
+	Until time.Time `json:",omitempty"`
+}
+
+// advance records that p was crawled up to end, and saves the checkpoint.
+func (cp *checkpoint) advance(p *partition, end time.Time, window time.Duration) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	p.End, p.Window = end, window
+	return cp.saveLocked()
+}
+
+func loadCheckpoint(path, source string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	if cp.Source != source {
+		return nil, fmt.Errorf("checkpoint %s is for source %q, not %q", path, cp.Source, source)
+	}
+	return cp, nil
+}
+
+// setPartitions replaces the partitions, and saves the checkpoint.
+func (cp *checkpoint) setPartitions(partitions []*partition) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Partitions = partitions
+	return cp.saveLocked()
+}
+
+// progress returns how much of the partitions' time ranges was crawled, and
+// how much there is in total.
+func (cp *checkpoint) progress() (done, total time.Duration) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, p := range cp.Partitions {
+		until := p.Until
+		if until.IsZero() {
+			until = time.Now()
+		}
+		done += p.End.Sub(p.Start)
+		total += until.Sub(p.Start)
+	}
+	return done, total
+}
+
+// save atomically replaces the checkpoint file, if any.
+func (cp *checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.saveLocked()
+}
+
+func (cp *checkpoint) saveLocked() error {
+	if *checkpointPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(cp, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(*checkpointPath), ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), *checkpointPath)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/githubauth"
+	"golang.org/x/oauth2"
+)
+
+// fakeUser is a synthetic GitHub account served by fakeGitHub.
+type fakeUser struct {
+	ID        uint64
+	Created   time.Time
+	Repos     int
+	Followers int
+	Keys      []string
+	Signing   []string // SSH signing keys, only served over REST
+	Org       bool     // organizations are listed, but not searched
+	Login     string   // defaults to userID
+}
+
+func (u *fakeUser) login() string {
+	if u.Login != "" {
+		return u.Login
+	}
+	return fmt.Sprintf("user%d", u.ID)
+}
+
+// fakeGitHub is an httptest server implementing the subset of the GitHub API
+// used by the crawler: user search by creation time, extra qualifiers and
+// join order, capped at 1000 results, user lookup by ID and login, key
+// pagination, and the REST listings of accounts by ID and of signing keys.
+// It can also inject server errors and rate limit responses.
+type fakeGitHub struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	// users is sorted by Created. Requests hold usersMu for reading, so
+	// that addUsers can change it while the crawler runs.
+	usersMu sync.RWMutex
+	users   []*fakeUser
+
+	// Every failEvery-th request fails with a 502, and every
+	// rateLimitEvery-th is rejected by a rate limit. Zero disables them.
+	failEvery, rateLimitEvery int
+
+	// quota, if not nil, is the number of requests each token can make
+	// before it is rate limited for an hour.
+	quota map[string]int
+
+	// unorderedTies makes sort:joined-desc searches list users created in
+	// the same second in ascending order, as GitHub doesn't promise either.
+	unorderedTies bool
+
+	mu       sync.Mutex
+	requests int
+	limited  int
+	byToken  map[string]int
+	windows  []fakeWindow
+}
+
+// fakeWindow is the first page of a search without extra qualifiers.
+type fakeWindow struct {
+	from, to time.Time // [from, to)
+	count    int
+}
+
+// newFakeGitHub starts a fakeGitHub, and points the crawler at it for the
+// duration of the test.
+func newFakeGitHub(t *testing.T, users []*fakeUser) *fakeGitHub {
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Created.Before(users[j].Created) })
+	f := &fakeGitHub{t: t, users: users}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+
+	oldInstance, oldClient, oldBackoff := githubInstance, client, retryBackoff
+	oldTokens, oldPause, oldREST := githubTokens, secondaryRateLimitPause, githubRESTInterval
+	oldResetPause, oldUnlisted := unknownResetPause, unlisted.Load()
+	githubInstance = &githubauth.Instance{Source: "github", WebURL: f.srv.URL,
+		APIURL: f.srv.URL, GraphQLURL: f.srv.URL + "/graphql"}
+	client = f.srv.Client()
+	retryBackoff = func(int) time.Duration { return time.Millisecond }
+	f.setTokens("test")
+	secondaryRateLimitPause = 10 * time.Millisecond
+	unknownResetPause = 10 * time.Millisecond // the fake quota resets in 10ms
+	githubRESTInterval = 0
+	t.Cleanup(func() {
+		githubInstance, client, retryBackoff = oldInstance, oldClient, oldBackoff
+		githubTokens, secondaryRateLimitPause, githubRESTInterval = oldTokens, oldPause, oldREST
+		unknownResetPause = oldResetPause
+		unlisted.Store(oldUnlisted)
+	})
+	return f
+}
+
+// setTokens points the crawler at a pool of the given personal tokens.
+func (f *fakeGitHub) setTokens(tokens ...string) {
+	var creds []githubauth.Credential
+	for _, tok := range tokens {
+		creds = append(creds, githubauth.Credential{Name: tok,
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})})
+	}
+	var err error
+	if githubTokens, err = newTokenPool(creds); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// checkQuota rejects requests made with a token that has no quota left, if
+// quotas are set, and counts the requests made with each token.
+func (f *fakeGitHub) checkQuota(w http.ResponseWriter, r *http.Request) bool {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.byToken == nil {
+		f.byToken = make(map[string]int)
+	}
+	f.byToken[tok]++
+	if f.quota == nil {
+		return false
+	}
+	if f.quota[tok] <= 0 {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusForbidden)
+		return true
+	}
+	f.quota[tok]--
+	return false
+}
+
+// injectFault writes an error or rate limit response, if it's time for one.
+func (f *fakeGitHub) injectFault(w http.ResponseWriter) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	switch {
+	case f.failEvery > 0 && f.requests%f.failEvery == 0:
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return true
+	case f.rateLimitEvery > 0 && f.requests%f.rateLimitEvery == 0:
+		f.limited++
+		switch f.limited % 3 {
+		case 0:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"message":"slow down"}`, http.StatusForbidden)
+		case 1:
+			http.Error(w, `{"message":"You have exceeded a secondary rate limit."}`, http.StatusForbidden)
+		case 2:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"rateLimit": f.rateLimit()},
+				"errors": []interface{}{map[string]interface{}{
+					"type": "RATE_LIMITED", "message": "API rate limit exceeded",
+				}},
+			})
+		}
+		return true
+	}
+	return false
+}
+
+func (f *fakeGitHub) rateLimit() interface{} {
+	return map[string]interface{}{
+		"cost": 1, "remaining": 1000000000, "resetAt": time.Now().Add(10 * time.Millisecond),
+	}
+}
+
+var (
+	fakeSearchRe = regexp.MustCompile(`query: "type:user created:(\S+)\.\.(\S+?)((?: [^"]+)?)"`)
+	fakeAfterRe  = regexp.MustCompile(`after: "(\d*)"`)
+	fakeNodeRe   = regexp.MustCompile(`node\(id: "U_(\d+)"\)`)
+	fakeNodesRe  = regexp.MustCompile(`nodes\(ids: \[([^\]]*)\]\)`)
+	fakeLoginRe  = regexp.MustCompile(`(u\d+): user\(login: "([^"]*)"\)`)
+	fakeRangeRe  = regexp.MustCompile(`^(\w+):(?:(\d+)|(\d+)\.\.(\d+)|>=(\d+))$`)
+)
+
+// addUsers makes users visible to the following requests.
+func (f *fakeGitHub) addUsers(users ...*fakeUser) {
+	f.usersMu.Lock()
+	defer f.usersMu.Unlock()
+	f.users = append(f.users, users...)
+	sort.SliceStable(f.users, func(i, j int) bool { return f.users[i].Created.Before(f.users[j].Created) })
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.usersMu.RLock()
+	defer f.usersMu.RUnlock()
+	switch r.URL.Path {
+	case "/graphql":
+		f.serveGraphQL(w, r)
+	case "/users":
+		f.serveUsers(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/users/") && strings.HasSuffix(r.URL.Path, "/ssh_signing_keys") {
+			login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/ssh_signing_keys")
+			f.serveSigningKeys(w, r, login)
+			return
+		}
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+// serveUsers lists the accounts with IDs greater than the since parameter.
+func (f *fakeGitHub) serveUsers(w http.ResponseWriter, r *http.Request) {
+	if f.checkQuota(w, r) || f.injectFault(w) {
+		return
+	}
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	byID := make([]*fakeUser, len(f.users))
+	copy(byID, f.users)
+	sort.Slice(byID, func(i, j int) bool { return byID[i].ID < byID[j].ID })
+	accounts := []interface{}{}
+	for _, u := range byID {
+		if u.ID <= since || len(accounts) == 100 {
+			continue
+		}
+		typ := "User"
+		if u.Org {
+			typ = "Organization"
+		}
+		accounts = append(accounts, map[string]interface{}{"id": u.ID, "login": u.login(), "type": typ})
+	}
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// serveSigningKeys lists the signing keys of a user, paginated like the REST
+// API with the page and per_page parameters and a Link header.
+func (f *fakeGitHub) serveSigningKeys(w http.ResponseWriter, r *http.Request, login string) {
+	if f.checkQuota(w, r) || f.injectFault(w) {
+		return
+	}
+	var user *fakeUser
+	for _, u := range f.users {
+		if !u.Org && u.login() == login {
+			user = u
+		}
+	}
+	if user == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	page, perPage := 1, 30
+	if p, err := strconv.Atoi(q.Get("page")); err == nil {
+		page = p
+	}
+	if p, err := strconv.Atoi(q.Get("per_page")); err == nil {
+		perPage = p
+	}
+	keys := []interface{}{}
+	for i := (page - 1) * perPage; i < page*perPage && i < len(user.Signing); i++ {
+		keys = append(keys, map[string]interface{}{"id": i + 1, "key": user.Signing[i], "title": "signing"})
+	}
+	if page*perPage < len(user.Signing) {
+		q.Set("page", strconv.Itoa(page+1))
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, f.srv.URL, r.URL.Path, q.Encode()))
+	}
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (f *fakeGitHub) user(u *fakeUser, keysOffset int) interface{} {
+	return map[string]interface{}{
+		"id":         fmt.Sprintf("U_%d", u.ID),
+		"databaseId": u.ID,
+		"login":      u.login(),
+		"name":       "",
+		"publicKeys": fakeKeyPage(u.Keys, keysOffset),
+	}
+}
+
+func (f *fakeGitHub) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.checkQuota(w, r) || f.injectFault(w) {
+		return
+	}
+	offset := 0
+	if m := fakeAfterRe.FindStringSubmatch(req.Query); m != nil && m[1] != "" {
+		offset, _ = strconv.Atoi(m[1])
+	}
+
+	data := map[string]interface{}{"rateLimit": f.rateLimit()}
+	switch {
+	case fakeSearchRe.MatchString(req.Query):
+		search, err := f.search(req.Query, offset)
+		if err != nil {
+			f.t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data["search"] = search
+	case fakeNodeRe.MatchString(req.Query):
+		id, _ := strconv.ParseUint(fakeNodeRe.FindStringSubmatch(req.Query)[1], 10, 64)
+		for _, u := range f.users {
+			if u.ID == id {
+				data["node"] = f.user(u, offset)
+			}
+		}
+	case fakeNodesRe.MatchString(req.Query) || fakeLoginRe.MatchString(req.Query):
+		for _, m := range fakeLoginRe.FindAllStringSubmatch(req.Query, -1) {
+			var node interface{}
+			for _, u := range f.users {
+				if !u.Org && u.login() == m[2] {
+					node = f.user(u, 0)
+				}
+			}
+			data[m[1]] = node
+		}
+		if m := fakeNodesRe.FindStringSubmatch(req.Query); m != nil {
+			nodes := []interface{}{}
+			for _, id := range strings.Split(m[1], ", ") {
+				var node interface{}
+				for _, u := range f.users {
+					if !u.Org && strconv.Quote(legacyUserNodeID(u.ID)) == id {
+						node = f.user(u, 0)
+					}
+				}
+				nodes = append(nodes, node)
+			}
+			data["nodes"] = nodes
+		}
+	default:
+		f.t.Errorf("unexpected query %s", req.Query)
+		http.Error(w, "unexpected query", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (f *fakeGitHub) search(query string, offset int) (interface{}, error) {
+	m := fakeSearchRe.FindStringSubmatch(query)
+	from, err := time.Parse(time.RFC3339, m[1])
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse(time.RFC3339, m[2])
+	if err != nil {
+		return nil, err
+	}
+	to = to.Add(time.Second) // created: ranges are inclusive
+	var qualifiers []string
+	desc := false
+	for _, q := range strings.Fields(m[3]) {
+		switch q {
+		case "sort:joined-asc":
+		case "sort:joined-desc":
+			desc = true
+		default:
+			qualifiers = append(qualifiers, q)
+		}
+	}
+	var matching []*fakeUser
+	for _, u := range f.users {
+		if u.Org || u.Created.Before(from) || !u.Created.Before(to) {
+			continue
+		}
+		ok, err := matchQualifiers(u, qualifiers)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matching = append(matching, u)
+		}
+	}
+	if desc && f.unorderedTies {
+		matching = append([]*fakeUser(nil), matching...)
+		sort.SliceStable(matching, func(i, j int) bool { return matching[i].Created.After(matching[j].Created) })
+	} else if desc {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+	if offset == 0 && len(qualifiers) == 0 {
+		f.mu.Lock()
+		f.windows = append(f.windows, fakeWindow{from: from, to: to, count: len(matching)})
+		f.mu.Unlock()
+	}
+
+	listable := len(matching)
+	if listable > 1000 {
+		listable = 1000
+	}
+	var edges []interface{}
+	for i := offset; i < offset+100 && i < listable; i++ {
+		edges = append(edges, map[string]interface{}{"node": f.user(matching[i], 0)})
+	}
+	return map[string]interface{}{
+		"userCount": len(matching),
+		"pageInfo": map[string]interface{}{
+			"hasNextPage": offset+100 < listable,
+			"endCursor":   strconv.Itoa(offset + 100),
+		},
+		"edges": edges,
+	}, nil
+}
+
+func matchQualifiers(u *fakeUser, qualifiers []string) (bool, error) {
+	for _, q := range qualifiers {
+		m := fakeRangeRe.FindStringSubmatch(q)
+		if m == nil {
+			return false, fmt.Errorf("unsupported qualifier %q", q)
+		}
+		var v int
+		switch m[1] {
+		case "repos":
+			v = u.Repos
+		case "followers":
+			v = u.Followers
+		default:
+			return false, fmt.Errorf("unsupported qualifier %q", q)
+		}
+		atoi := func(s string) int { n, _ := strconv.Atoi(s); return n }
+		switch {
+		case m[2] != "" && v != atoi(m[2]):
+			return false, nil
+		case m[3] != "" && (v < atoi(m[3]) || v > atoi(m[4])):
+			return false, nil
+		case m[5] != "" && v < atoi(m[5]):
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func fakeKeyPage(keys []string, offset int) interface{} {
+	var nodes []interface{}
+	for i := offset; i < offset+100 && i < len(keys); i++ {
+		nodes = append(nodes, map[string]interface{}{"key": keys[i]})
+	}
+	return map[string]interface{}{
+		"pageInfo": map[string]interface{}{
+			"hasNextPage": offset+100 < len(keys),
+			"endCursor":   strconv.Itoa(offset + 100),
+		},
+		"nodes": nodes,
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var giteaURL = flag.String("gitea-url", "https://codeberg.org", "base URL of the Gitea or Forgejo instance")
+
+var giteaToken = os.Getenv("GITEA_TOKEN")
+
+var giteaInterval = 100 * time.Millisecond
+
+type giteaUser struct {
+	ID       uint64 `json:"id"`
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+}
+
+type giteaKey struct {
+	Key string `json:"key"`
+}
+
+// crawlGitea lists every user of the Gitea-compatible instance at baseURL, and
+// emits their SSH keys. The source of the records is the host name of the
+// instance. cp.Cursor is the number of the next page of users.
+//
+// The search API only pages through users in alphabetical order, so pages
+// shift as users sign up or are deleted during the crawl. Users seen twice
+// because of that are skipped the second time, but those shifted into a page
+// already crawled, or sorting before it, are missed until the next crawl.
+func crawlGitea(baseURL string, cp *checkpoint, out *output, stop <-chan struct{}) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	source := u.Host
+
+	header := http.Header{}
+	if giteaToken != "" {
+		header.Set("Authorization", "token "+giteaToken)
+	}
+	rate := time.NewTicker(giteaInterval)
+	defer rate.Stop()
+
+	page := 1
+	if cp.Cursor != "" {
+		if page, err = strconv.Atoi(cp.Cursor); err != nil {
+			log.Fatalf("invalid Gitea cursor %q: %v", cp.Cursor, err)
+		}
+	}
+	seen := make(map[uint64]bool)
+	for ; ; page++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		<-rate.C
+		var res struct {
+			Data []giteaUser `json:"data"`
+		}
+		_, err := getJSON(nil, fmt.Sprintf("%s/api/v1/users/search?page=%d&limit=50", baseURL, page), header, &res)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(res.Data) == 0 {
+			return
+		}
+
+		var records []record
+		for _, u := range res.Data {
+			if seen[u.ID] {
+				continue
+			}
+			seen[u.ID] = true
+			<-rate.C
+			var keys []giteaKey
+			_, err := getJSON(nil, fmt.Sprintf("%s/api/v1/users/%s/keys", baseURL, url.PathEscape(u.Login)), header, &keys)
+			if err == errNotFound {
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, k := range keys {
+				records = append(records, record{Source: source, ID: u.ID, Key: k.Key,
+					Kind: kindAuthentication, Login: u.Login, Name: u.FullName})
+			}
+		}
+		out.write(records)
+		usersCrawled.Add(float64(len(res.Data)))
+		keysCrawled.Add(float64(len(records)))
+
+		log.Printf("[%s page %d] %d users, got %d keys", source, page, len(res.Data), len(records))
+		cp.Cursor = strconv.Itoa(page + 1)
+		if err := cp.save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrawlGitea(t *testing.T) {
+	defer func(d time.Duration) { giteaInterval = d }(giteaInterval)
+	giteaInterval = time.Millisecond
+
+	const userCount = 120
+	keys := map[string][]string{
+		"user7":   {"ssh-ed25519 AAAA7"},
+		"user35":  {"ssh-ed25519 AAAA35"}, // last of the first page
+		"user51":  {"ssh-ed25519 AAAA51a", "ssh-rsa AAAA51b"},
+		"user120": {"ssh-ed25519 AAAA120"},
+	}
+
+	var users []giteaUser
+	for id := 1; id <= userCount; id++ {
+		users = append(users, giteaUser{ID: uint64(id),
+			Login: fmt.Sprintf("user%d", id), FullName: fmt.Sprintf("User %d", id)})
+	}
+
+	// Like Gitea, the search API sorts users by name, and one signs up after
+	// the first page, shifting the rest by one.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/users/search", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+		var res struct {
+			Data []giteaUser `json:"data"`
+		}
+		res.Data = []giteaUser{}
+		for i := (page - 1) * limit; i < page*limit && i < len(users); i++ {
+			res.Data = append(res.Data, users[i])
+		}
+		json.NewEncoder(w).Encode(res)
+		if page == 1 {
+			users = append(users, giteaUser{ID: userCount + 1, Login: "aaron"})
+		}
+	})
+	mux.HandleFunc("/api/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"), "/keys")
+		if login == "user99" {
+			http.NotFound(w, r)
+			return
+		}
+		res := []giteaKey{}
+		for _, k := range keys[login] {
+			res = append(res, giteaKey{Key: k})
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	crawlGitea(srv.URL, &checkpoint{Source: "gitea"}, &output{enc: json.NewEncoder(buf)}, nil)
+
+	u, _ := url.Parse(srv.URL)
+	want := map[record]bool{
+		{Source: u.Host, ID: 7, Kind: kindAuthentication, Key: "ssh-ed25519 AAAA7", Login: "user7", Name: "User 7"}:         true,
+		{Source: u.Host, ID: 35, Kind: kindAuthentication, Key: "ssh-ed25519 AAAA35", Login: "user35", Name: "User 35"}:     true,
+		{Source: u.Host, ID: 51, Kind: kindAuthentication, Key: "ssh-ed25519 AAAA51a", Login: "user51", Name: "User 51"}:    true,
+		{Source: u.Host, ID: 51, Kind: kindAuthentication, Key: "ssh-rsa AAAA51b", Login: "user51", Name: "User 51"}:        true,
+		{Source: u.Host, ID: 120, Kind: kindAuthentication, Key: "ssh-ed25519 AAAA120", Login: "user120", Name: "User 120"}: true,
+	}
+	checkRecords(t, buf, want)
+}
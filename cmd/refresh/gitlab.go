@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var gitlabURL = flag.String("gitlab-url", "https://gitlab.com", "base URL of the GitLab instance")
+
+var gitlabToken = os.Getenv("GITLAB_TOKEN")
+
+// gitlabInterval paces requests to stay well under GitLab.com's limit of
+// 2000 authenticated API requests per minute.
+var gitlabInterval = 50 * time.Millisecond
+
+type gitlabUser struct {
+	ID       uint64 `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type gitlabKey struct {
+	Key       string `json:"key"`
+	UsageType string `json:"usage_type"` // auth, signing, or auth_and_signing
+}
+
+func (k gitlabKey) kinds() []string {
+	switch k.UsageType {
+	case "signing":
+		return []string{kindSigning}
+	case "auth_and_signing":
+		return []string{kindAuthentication, kindSigning}
+	default:
+		return []string{kindAuthentication}
+	}
+}
+
+// crawlGitLab lists every user of the instance at baseURL in ID order, and
+// emits their SSH keys. The source of the records is "gitlab" for gitlab.com,
+// or the host name of a self-hosted instance, which has its own user IDs.
+// cp.Cursor is the URL of the next page of users, and cp.Complete is set
+// after the last one.
+func crawlGitLab(baseURL string, cp *checkpoint, out *output, stop <-chan struct{}) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	source := u.Host
+	if source == "gitlab.com" {
+		source = "gitlab"
+	}
+
+	header := http.Header{}
+	if gitlabToken != "" {
+		header.Set("PRIVATE-TOKEN", gitlabToken)
+	}
+	rate := time.NewTicker(gitlabInterval)
+	defer rate.Stop()
+
+	if cp.Complete {
+		log.Printf("[%s] the checkpointed crawl already completed", source)
+		return
+	}
+	if cp.Cursor == "" {
+		cp.Cursor = baseURL + "/api/v4/users?pagination=keyset&order_by=id&sort=asc&per_page=100"
+	}
+	for cp.Cursor != "" {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		<-rate.C
+		var users []gitlabUser
+		next, err := getJSON(nil, cp.Cursor, header, &users)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var records []record
+		for _, u := range users {
+			<-rate.C
+			var keys []gitlabKey
+			_, err := getJSON(nil, fmt.Sprintf("%s/api/v4/users/%d/keys", baseURL, u.ID), header, &keys)
+			if err == errNotFound {
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, k := range keys {
+				for _, kind := range k.kinds() {
+					records = append(records, record{Source: source, ID: u.ID, Key: k.Key,
+						Kind: kind, Login: u.Username, Name: u.Name})
+				}
+			}
+		}
+		out.write(records)
+		usersCrawled.Add(float64(len(users)))
+		keysCrawled.Add(float64(len(records)))
+
+		if len(users) > 0 {
+			log.Printf("[%s users %d to %d] %d users, got %d keys", source,
+				users[0].ID, users[len(users)-1].ID, len(users), len(records))
+		}
+		cp.Cursor, cp.Complete = next, next == ""
+		if err := cp.save(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
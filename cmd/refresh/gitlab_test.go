@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gitlabTestKeys are the keys of the users of newFakeGitLab, by user ID.
+var gitlabTestKeys = map[uint64][]gitlabKey{
+	2: {{Key: "ssh-ed25519 AAAA2", UsageType: "auth"}},
+	4: {{Key: "ssh-ed25519 AAAA4a", UsageType: "signing"}, {Key: "ssh-rsa AAAA4b", UsageType: "auth"}},
+	6: {{Key: "ssh-ed25519 AAAA6", UsageType: "auth_and_signing"}},
+	7: {{Key: "ssh-ed25519 AAAA7"}}, // before GitLab 15.7, there's no usage_type
+}
+
+// fakeGitLab serves users 1 to 8 of a GitLab instance, three per page with
+// keyset pagination, where user 5 disappears before its keys are fetched.
+type fakeGitLab struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+// newFakeGitLab starts a fakeGitLab. base is the URL the instance is reached
+// at, for the Link headers.
+func newFakeGitLab(t *testing.T, base *string) *fakeGitLab {
+	oldInterval := gitlabInterval
+	gitlabInterval = time.Millisecond
+	t.Cleanup(func() { gitlabInterval = oldInterval })
+
+	const userCount, perPage = 8, 3
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("pagination") != "keyset" || q.Get("order_by") != "id" || q.Get("sort") != "asc" {
+			t.Errorf("unexpected users query %q", r.URL.RawQuery)
+		}
+		after, _ := strconv.Atoi(q.Get("id_after"))
+		users := []gitlabUser{}
+		for id := after + 1; id <= userCount && len(users) < perPage; id++ {
+			users = append(users, gitlabUser{ID: uint64(id),
+				Username: fmt.Sprintf("user%d", id), Name: fmt.Sprintf("User %d", id)})
+		}
+		if last := after + len(users); last < userCount {
+			q.Set("id_after", strconv.Itoa(last))
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v4/users?%s>; rel="next"`, *base, q.Encode()))
+		}
+		json.NewEncoder(w).Encode(users)
+	})
+	mux.HandleFunc("/api/v4/users/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v4/users/"), "/keys"), 10, 64)
+		if err != nil || id == 5 {
+			http.NotFound(w, r)
+			return
+		}
+		keys := gitlabTestKeys[id]
+		if keys == nil {
+			keys = []gitlabKey{}
+		}
+		json.NewEncoder(w).Encode(keys)
+	})
+	f := &fakeGitLab{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests.Add(1)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// gitlabTestRecords returns the records expected from newFakeGitLab.
+func gitlabTestRecords(source string) map[record]bool {
+	r := func(id uint64, kind, key string) record {
+		return record{Source: source, ID: id, Kind: kind, Key: key,
+			Login: fmt.Sprintf("user%d", id), Name: fmt.Sprintf("User %d", id)}
+	}
+	return map[record]bool{
+		r(2, kindAuthentication, "ssh-ed25519 AAAA2"): true,
+		r(4, kindSigning, "ssh-ed25519 AAAA4a"):       true,
+		r(4, kindAuthentication, "ssh-rsa AAAA4b"):    true,
+		r(6, kindAuthentication, "ssh-ed25519 AAAA6"): true,
+		r(6, kindSigning, "ssh-ed25519 AAAA6"):        true,
+		r(7, kindAuthentication, "ssh-ed25519 AAAA7"): true,
+	}
+}
+
+// checkRecords checks that buf holds exactly the want records, once each.
+func checkRecords(t *testing.T, buf *bytes.Buffer, want map[record]bool) {
+	t.Helper()
+	d := json.NewDecoder(buf)
+	for d.More() {
+		var r record
+		if err := d.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if !want[r] {
+			t.Errorf("unexpected or duplicate record %+v", r)
+		}
+		delete(want, r)
+	}
+	for r := range want {
+		t.Errorf("missing record %+v", r)
+	}
+}
+
+func TestCrawlGitLab(t *testing.T) {
+	t.Run("self-hosted", func(t *testing.T) {
+		var base string
+		srv := newFakeGitLab(t, &base)
+		base = srv.URL
+
+		buf := &bytes.Buffer{}
+		crawlGitLab(base, &checkpoint{Source: "gitlab"}, &output{enc: json.NewEncoder(buf)}, nil)
+		u, _ := url.Parse(srv.URL)
+		checkRecords(t, buf, gitlabTestRecords(u.Host))
+	})
+
+	t.Run("gitlab.com", func(t *testing.T) {
+		base := "https://gitlab.com"
+		srv := newFakeGitLab(t, &base)
+		oldClient := client
+		client = &http.Client{Transport: rewriteTransport{srv.URL}}
+		t.Cleanup(func() { client = oldClient })
+
+		buf := &bytes.Buffer{}
+		crawlGitLab(base, &checkpoint{Source: "gitlab"}, &output{enc: json.NewEncoder(buf)}, nil)
+		checkRecords(t, buf, gitlabTestRecords("gitlab"))
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		var base string
+		srv := newFakeGitLab(t, &base)
+		base = srv.URL
+		oldPath := *checkpointPath
+		*checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+		t.Cleanup(func() { *checkpointPath = oldPath })
+
+		buf := &bytes.Buffer{}
+		crawlGitLab(base, &checkpoint{Source: "gitlab"}, &output{enc: json.NewEncoder(buf)}, nil)
+		u, _ := url.Parse(srv.URL)
+		checkRecords(t, buf, gitlabTestRecords(u.Host))
+
+		// Resuming a completed crawl must not start it over.
+		cp, err := loadCheckpoint(*checkpointPath, "gitlab")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cp.Complete {
+			t.Errorf("checkpoint of a completed crawl is not marked complete")
+		}
+		requests := srv.requests.Load()
+		crawlGitLab(base, cp, &output{enc: json.NewEncoder(buf)}, nil)
+		if buf.Len() != 0 {
+			t.Errorf("resumed completed crawl emitted records:\n%s", buf)
+		}
+		if n := srv.requests.Load() - requests; n != 0 {
+			t.Errorf("resumed completed crawl made %d requests", n)
+		}
+	})
+}
+
+// rewriteTransport sends every request to the server at URL instead.
+type rewriteTransport struct{ URL string }
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, err := url.Parse(rt.URL)
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host, r.Host = u.Scheme, u.Host, ""
+	return http.DefaultTransport.RoundTrip(r)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+var untilID = flag.Uint64("until-id", 0, "with -source github-ids, stop after this user ID (default: the latest)")
+
+// restAccount is an entry of the REST listing of all users and organizations.
+type restAccount struct {
+	ID    uint64 `json:"id"`
+	Login string `json:"login"`
+	Type  string `json:"type"` // User or Organization
+}
+
+// crawlGitHubIDs lists GitHub accounts in database ID order with the REST
+// /users?since= API, starting after cp.Cursor, and emits the keys of the users
+// among them, fetched in batches by ID with fetchUsers. It doesn't depend on
+// search, so its output can be used to cross-check the coverage of
+// crawlGitHub. cp.Cursor is the last listed ID.
+func crawlGitHubIDs(cp *checkpoint, out *output, stop <-chan struct{}) {
+	var since uint64
+	if cp.Cursor != "" {
+		var err error
+		if since, err = strconv.ParseUint(cp.Cursor, 10, 64); err != nil {
+			log.Fatalf("invalid GitHub ID cursor %q: %v", cp.Cursor, err)
+		}
+	}
+	var users, keys int
+	for *untilID == 0 || since < *untilID {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		var accounts []restAccount
+		_, err := getGitHubJSON(fmt.Sprintf("%s/users?since=%d&per_page=100", githubInstance.APIURL, since), &accounts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(accounts) == 0 {
+			break
+		}
+
+		last := accounts[len(accounts)-1].ID
+		var ids []string
+		for _, a := range accounts {
+			if *untilID != 0 && a.ID > *untilID {
+				last = *untilID
+				break
+			}
+			if a.Type == "User" {
+				ids = append(ids, "id:"+strconv.FormatUint(a.ID, 10))
+			}
+		}
+		var records []record
+		var found int
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > usersPerQuery {
+				batch = batch[:usersPerQuery]
+			}
+			ids = ids[len(batch):]
+			rr, n, err := fetchUsers(batch)
+			if err != nil {
+				log.Fatal(err)
+			}
+			records = append(records, rr...)
+			found += n
+		}
+		out.write(records)
+		users += found
+		keys += len(records)
+		usersCrawled.Add(float64(found))
+		keysCrawled.Add(float64(len(records)))
+
+		log.Printf("[GitHub IDs %d to %d] %d accounts, %d users, got %d keys",
+			since+1, last, len(accounts), found, len(records))
+		since = last
+		cp.Cursor = strconv.FormatUint(since, 10)
+		if err := cp.save(); err != nil {
+			log.Fatal(err)
+		}
+		positionID.Set(float64(since))
+	}
+	log.Printf("Done: %d users, %d keys", users, keys)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = flag.String("metrics", "", "serve Prometheus metrics at /metrics on this address, such as :9092")
+
+var (
+	windowsDone = promauto.NewCounter(prometheus.CounterOpts{Name: "refresh_windows_total",
+		Help: "GitHub search windows completed."})
+	usersCrawled = promauto.NewCounter(prometheus.CounterOpts{Name: "refresh_users_total",
+		Help: "Users whose keys were fetched."})
+	keysCrawled = promauto.NewCounter(prometheus.CounterOpts{Name: "refresh_keys_total",
+		Help: "Key records emitted."})
+	usersUnlisted = promauto.NewCounter(prometheus.CounterOpts{Name: "refresh_unlisted_users_total",
+		Help: "Users in GitHub windows too dense to list them all, which make the crawl fail."})
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{Name: "refresh_api_errors_total",
+		Help: "Failed API requests, by whether they were rate limited."}, []string{"ratelimited"})
+	apiRetries = promauto.NewCounter(prometheus.CounterOpts{Name: "refresh_api_retries_total",
+		Help: "API requests retried after an error other than a rate limit."})
+	quotaRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "refresh_quota_remaining",
+		Help: "Last known GraphQL quota left, by credential."}, []string{"limiter"})
+	positionTime = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "refresh_position_seconds",
+		Help: "End of the last completed window of each GitHub partition, by index, as a UNIX timestamp."}, []string{"partition"})
+	positionID = promauto.NewGauge(prometheus.GaugeOpts{Name: "refresh_position_id",
+		Help: "Last listed ID of a crawl by GitHub user ID."})
+)
+
+// serveMetrics serves the metrics at -metrics, if set.
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: *metricsAddr, Handler: mux,
+		ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go func() { log.Fatal(srv.ListenAndServe()) }()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var githubInterval = flag.Duration("rate", 0, "minimum interval between GitHub API requests with each credential, on top of quota-based pacing")
+
+// githubRESTInterval spreads the REST API quota of 5000 requests per hour.
+var githubRESTInterval = time.Hour / 5000
+
+// secondaryRateLimitPause is how long to wait after a secondary rate limit
+// response without Retry-After. GitHub asks for at least a minute.
+var secondaryRateLimitPause = 1 * time.Minute
+
+// unknownResetPause is how long to wait after running out of quota, if the
+// time it resets is unknown or already past.
+var unknownResetPause = 1 * time.Minute
+
+// quotaReserve is the number of GraphQL points left unspent at the end of
+// each rate limit window, to leave room for other users of the token.
+const quotaReserve = 100
+
+// rateLimit is the GraphQL rateLimit object.
+type rateLimit struct {
+	Cost      int       `json:"cost"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+// A rateLimitError is returned by requests rejected by a primary or secondary
+// rate limit. The limiter is already paused until the given time.
+type rateLimitError struct {
+	until time.Time
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited until %v", e.until.Format(time.RFC3339))
+}
+
+// A limiter spaces out requests by at least *interval, and spreads the
+// remaining quota evenly until it resets.
+type limiter struct {
+	name     string // for logging
+	interval *time.Duration
+
+	mu     sync.Mutex
+	next   time.Time
+	paced  time.Duration
+	quota  rateLimit
+	paused time.Time
+}
+
+// wait blocks until the next request slot, and past any pause that started
+// while waiting.
+func (l *limiter) wait() {
+	for !l.reserve() {
+		time.Sleep(time.Until(l.pausedUntil()))
+	}
+}
+
+// reserve blocks until the next request slot, unless l is paused. It returns
+// false if l was paused before or while waiting.
+func (l *limiter) reserve() bool {
+	l.mu.Lock()
+	now := time.Now()
+	if l.paused.After(now) {
+		l.mu.Unlock()
+		return false
+	}
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	interval := *l.interval
+	if l.paced > interval {
+		interval = l.paced
+	}
+	l.next = t.Add(interval)
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(t))
+	return !l.pausedUntil().After(time.Now())
+}
+
+// pausedUntil returns the end of the current or last pause.
+func (l *limiter) pausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// update paces the following requests so that the quota left after a request
+// of the given cost lasts until it resets.
+func (l *limiter) update(rl *rateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.quota = *rl
+	quotaRemaining.WithLabelValues(l.name).Set(float64(rl.Remaining))
+	cost := rl.Cost
+	if cost < 1 {
+		cost = 1
+	}
+	left := (rl.Remaining - quotaReserve) / cost
+	if left < 1 {
+		l.pauseLocked(rl.ResetAt, fmt.Sprintf("quota nearly exhausted (%d points left)", rl.Remaining))
+		l.paced = 0
+		return
+	}
+	l.paced = time.Until(rl.ResetAt) / time.Duration(left)
+}
+
+// pause holds off all requests until t.
+func (l *limiter) pause(t time.Time, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pauseLocked(t, reason)
+}
+
+func (l *limiter) pauseLocked(t time.Time, reason string) {
+	if t.After(l.next) {
+		l.next = t
+	}
+	if t.After(l.paused) {
+		l.paused = t
+		log.Printf("Pausing %s requests until %v: %s", l.name, t.Format(time.RFC3339), reason)
+	}
+}
+
+// pauseForReset pauses until the last known quota reset, or for
+// unknownResetPause if it's unknown or past.
+func (l *limiter) pauseForReset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.quota.ResetAt
+	if t.Before(time.Now()) {
+		t = time.Now().Add(unknownResetPause)
+	}
+	l.pauseLocked(t, "quota exhausted")
+	return &rateLimitError{until: t}
+}
+
+// remaining returns the last known quota left.
+func (l *limiter) remaining() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.quota.Remaining
+}
+
+// check detects GitHub primary and secondary rate limit responses, pauses l
+// accordingly, and returns a *rateLimitError.
+//
+// See https://docs.github.com/en/rest/overview/resources-in-the-rest-api#rate-limiting.
+func (l *limiter) check(res *http.Response, body []byte) error {
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	if s := res.Header.Get("Retry-After"); s != "" {
+		if secs, err := strconv.Atoi(s); err == nil {
+			t := time.Now().Add(time.Duration(secs) * time.Second)
+			l.pause(t, "Retry-After "+s)
+			return &rateLimitError{until: t}
+		}
+	}
+	if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			t := time.Unix(reset, 0)
+			l.pause(t, "primary rate limit")
+			return &rateLimitError{until: t}
+		}
+	}
+	if bytes.Contains(bytes.ToLower(body), []byte("secondary rate limit")) {
+		t := time.Now().Add(secondaryRateLimitPause)
+		l.pause(t, "secondary rate limit")
+		return &rateLimitError{until: t}
+	}
+	return nil
+}
@@ -4,37 +4,311 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/githubauth"
 )
 
 const targetPerSearch = 800
 
+// minWindow is the resolution of the created: search qualifier. Windows of
+// minWindow with more than 1000 users are split with qualifierSplits, and
+// listed from both ends if that's not enough.
+const minWindow = 1 * time.Second
+
+var source = flag.String("source", "github", "key source to crawl: github, github-ids (GitHub by user ID), gitlab, or gitea")
+var workers = flag.Int("workers", 1, "number of GitHub time ranges to crawl in parallel")
+var until = flag.String("until", "", "end of the GitHub crawl as an RFC 3339 time (default: the present)")
+var follow = flag.Duration("follow", 0, "after reaching the present, keep crawling new GitHub users at this interval")
+var overlap = flag.Duration("overlap", 24*time.Hour, "in -follow mode, how far back to re-crawl for late-indexed users")
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: refresh [-source github] [-github-url URL] [-workers N -until END_TIME] [-checkpoint FILE] START_TIME\n")
+		fmt.Fprintf(os.Stderr, "       refresh [-source github] -follow INTERVAL [-overlap DURATION] [-checkpoint FILE] START_TIME\n")
+		fmt.Fprintf(os.Stderr, "       refresh -source github-ids [-until-id END_ID] [-checkpoint FILE] [START_ID]\n")
+		fmt.Fprintf(os.Stderr, "       refresh -users FILE\n")
+		fmt.Fprintf(os.Stderr, "       refresh -replay ARCHIVE\n")
+		fmt.Fprintf(os.Stderr, "       refresh [-source SOURCE] -checkpoint FILE -resume\n")
+		fmt.Fprintf(os.Stderr, "       refresh -source gitlab [-gitlab-url URL]\n")
+		fmt.Fprintf(os.Stderr, "       refresh -source gitea [-gitea-url URL]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	instance, err := githubauth.ParseInstance(*githubURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	githubInstance = instance
+	serveMetrics()
+
 	intC := make(chan os.Signal, 1)
 	signal.Notify(intC, os.Interrupt)
+	stop := make(chan struct{})
+	go func() {
+		<-intC
+		log.Println("Interrupted, finishing current windows...")
+		close(stop)
+	}()
+
+	if *replayPath != "" {
+		if err := replay(*replayPath, &output{enc: json.NewEncoder(os.Stdout)}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *archivePath != "" {
+		var err error
+		responseArchive, err = openArchive(*archivePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := responseArchive.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	cp := &checkpoint{Source: *source}
+	if *resume {
+		if *checkpointPath == "" {
+			log.Fatal("-resume requires -checkpoint")
+		}
+		var err error
+		cp, err = loadCheckpoint(*checkpointPath, *source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Resuming from checkpoint %s", *checkpointPath)
+	}
+
+	out := &output{enc: json.NewEncoder(os.Stdout)}
+	switch *source {
+	case "github":
+		loadGitHubTokens()
+		if *usersFile != "" {
+			crawlUsers(*usersFile, out, stop)
+			return
+		}
+		if !*resume {
+			start, err := time.Parse(time.RFC3339, flag.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			var end time.Time
+			if *until != "" {
+				end, err = time.Parse(time.RFC3339, *until)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else if *workers > 1 {
+				end = time.Now().Truncate(minWindow)
+			}
+			cp.Partitions = partitionRange(start, end, *workers)
+		}
+		crawlGitHub(cp, out, stop)
+		failIfIncomplete()
+		if *follow > 0 {
+			followGitHub(cp, out, stop)
+		}
+	case "github-ids":
+		if *follow > 0 {
+			log.Fatal("-follow is only supported for -source github")
+		}
+		loadGitHubTokens()
+		if !*resume && flag.Arg(0) != "" {
+			if _, err := strconv.ParseUint(flag.Arg(0), 10, 64); err != nil {
+				log.Fatalf("invalid START_ID %q", flag.Arg(0))
+			}
+			cp.Cursor = flag.Arg(0)
+		}
+		crawlGitHubIDs(cp, out, stop)
+	case "gitlab":
+		if *follow > 0 {
+			log.Fatal("-follow is only supported for -source github")
+		}
+		crawlGitLab(*gitlabURL, cp, out, stop)
+	case "gitea":
+		if *follow > 0 {
+			log.Fatal("-follow is only supported for -source github")
+		}
+		crawlGitea(*giteaURL, cp, out, stop)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
 
-	start, err := time.Parse(time.RFC3339, os.Args[1])
+// loadGitHubTokens sets githubTokens from the environment.
+func loadGitHubTokens() {
+	creds, err := githubauth.FromEnv(client, githubInstance.APIURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	githubTokens, err = newTokenPool(creds)
 	if err != nil {
 		log.Fatal(err)
 	}
-	end := start.Add(1 * time.Hour)
+	log.Printf("Crawling with %d GitHub credentials", len(creds))
+}
+
+// output is the JSONL stream shared by all workers.
+type output struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (o *output) write(records []record) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, r := range records {
+		if err := o.enc.Encode(r); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
 
-	out := json.NewEncoder(os.Stdout)
-	for time.Now().After(start) {
+// partitionRange splits [start, end) into n equal partitions, with bounds
+// truncated to minWindow, as searches are. A zero end means the present, and
+// allows only one partition.
+func partitionRange(start, end time.Time, n int) []*partition {
+	start = start.Truncate(minWindow)
+	if end.IsZero() || n < 1 {
+		n = 1
+	}
+	if end.IsZero() {
+		return []*partition{{Start: start, End: start, Window: 1 * time.Hour}}
+	}
+	var partitions []*partition
+	size := end.Sub(start) / time.Duration(n)
+	for i := 0; i < n; i++ {
+		p := &partition{Start: start.Add(size * time.Duration(i)).Truncate(minWindow),
+			Window: 1 * time.Hour, Until: start.Add(size * time.Duration(i+1)).Truncate(minWindow)}
+		p.End = p.Start
+		if i == n-1 {
+			p.Until = end.Truncate(minWindow)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions
+}
+
+// crawlGitHub crawls each of cp.Partitions in parallel, and emits the SSH
+// keys of their users.
+func crawlGitHub(cp *checkpoint, out *output, stop <-chan struct{}) {
+	began := time.Now()
+	doneBefore, _ := cp.progress()
+	eta := func() time.Duration {
+		done, total := cp.progress()
+		if done <= doneBefore {
+			return 0
+		}
+		elapsed := time.Since(began)
+		return (elapsed * time.Duration(total-done) / time.Duration(done-doneBefore)).Round(time.Minute)
+	}
+
+	// The partitions of a previous crawl in -follow mode are gone.
+	positionTime.Reset()
+
+	var wg sync.WaitGroup
+	for i, p := range cp.Partitions {
+		wg.Add(1)
+		go func(i int, p *partition) {
+			defer wg.Done()
+			crawlPartition(cp, i, p, out, stop, eta)
+		}(i, p)
+	}
+	wg.Wait()
+}
+
+// followGitHub repeatedly crawls from the end of the last crawl, minus the
+// overlap, to the present, once every follow interval, until stopped.
+func followGitHub(cp *checkpoint, out *output, stop <-chan struct{}) {
+	for {
 		select {
-		case <-intC:
+		case <-stop:
+			return
+		case <-time.After(*follow):
+		}
+
+		var latest time.Time
+		window := 1 * time.Hour
+		for _, p := range cp.Partitions {
+			if p.End.After(latest) {
+				latest, window = p.End, p.Window
+			}
+		}
+		if window > *overlap {
+			window = *overlap
+		}
+		start := latest.Add(-*overlap).Truncate(minWindow)
+		log.Printf("Following from %v...", start.Format(time.RFC3339))
+		if err := cp.setPartitions([]*partition{{Start: start, End: start, Window: window}}); err != nil {
+			log.Fatal(err)
+		}
+		crawlGitHub(cp, out, stop)
+		failIfIncomplete()
+	}
+}
+
+// unlisted is the number of users searchSplit could not list.
+var unlisted atomic.Int64
+
+// failIfIncomplete exits with an error if any user could not be listed.
+// Progress up to this point was still emitted and checkpointed.
+func failIfIncomplete() {
+	if n := unlisted.Load(); n > 0 {
+		log.Fatalf("%d users could not be listed, the crawl is incomplete", n)
+	}
+}
+
+// crawlPartition searches users by creation time, in windows sized to return
+// about targetPerSearch users each, from p.End to p.Until. p is cp.Partitions[i].
+func crawlPartition(cp *checkpoint, i int, p *partition, out *output, stop <-chan struct{}, eta func() time.Duration) {
+	start, end := p.End, p.End.Add(p.Window)
+	for {
+		limit := p.Until
+		if limit.IsZero() {
+			limit = time.Now().Truncate(minWindow)
+		}
+		if limit.Sub(start) < minWindow {
+			return
+		}
+		end = end.Truncate(minWindow)
+		if end.Sub(start) < minWindow {
+			end = start.Add(minWindow)
+		}
+		if end.After(limit) {
+			end = limit
+		}
+
+		select {
+		case <-stop:
 			return
 		default:
 		}
 
-		keys, count, err := search(start, end)
+		records, count, err := search(start, end, "", false)
+		if err == errTooManyResults && end.Sub(start) <= minWindow {
+			log.Printf("[%v to %v] %d users, splitting by qualifiers...",
+				start.Format(time.RFC3339), end.Format(time.RFC3339), count)
+			records, count, err = searchSplit(start, end, "", 0)
+		}
 		if err != nil && err != errTooManyResults {
 			log.Fatal(err)
 		}
@@ -52,47 +326,146 @@ func main() {
 			continue
 		}
 
-		for key, uid := range keys {
-			out.Encode(struct {
-				ID  uint64 `json:"id"`
-				Key string `json:"key"`
-			}{uid, key})
-		}
+		out.write(records)
 
-		log.Printf("[%v to %v] %d users, got %d keys",
-			start.Format(time.RFC3339), end.Format(time.RFC3339), count, len(keys))
 		newRange = (oldRange*4 + newRange) / 5 // soften steady-state swings
+		if newRange < minWindow {
+			newRange = minWindow
+		}
+		if err := cp.advance(p, end, newRange); err != nil {
+			log.Fatal(err)
+		}
+		windowsDone.Inc()
+		usersCrawled.Add(float64(count))
+		keysCrawled.Add(float64(len(records)))
+		positionTime.WithLabelValues(strconv.Itoa(i)).Set(float64(end.Unix()))
+
+		log.Printf("[%v to %v] %d users, got %d keys; %d points left, ETA %v",
+			start.Format(time.RFC3339), end.Format(time.RFC3339), count, len(records),
+			githubTokens.remaining(), eta())
 		start, end = end, end.Add(newRange)
 	}
 }
 
 var errTooManyResults = errors.New("more than 1000 results")
 
-func search(from, to time.Time) (keys map[string]uint64, count int, err error) {
+// record is a line of the JSONL output, consumed by cmd/index.
+type record struct {
+	Source string `json:"source"`
+	ID     uint64 `json:"id"`
+	Key    string `json:"key"`
+	Kind   string `json:"kind"`
+	Login  string `json:"login,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// Key kinds. A key registered for both has a record of each kind.
+const (
+	kindAuthentication = "authentication"
+	kindSigning        = "signing"
+)
+
+// qualifierSplits are search qualifiers that partition users, used in turn to
+// enumerate windows of minWindow that have more than 1000 users.
+var qualifierSplits = [][]string{
+	{"repos:0", "repos:1", "repos:2..3", "repos:4..7", "repos:8..15", "repos:16..31", "repos:>=32"},
+	{"followers:0", "followers:1", "followers:2..4", "followers:>=5"},
+}
+
+// searchSplit searches the users in [from, to) matching qualifiers once for
+// each of qualifierSplits[depth], splitting further where there are still
+// more than 1000 users, and searching from both ends when out of splits.
+func searchSplit(from, to time.Time, qualifiers string, depth int) (records []record, count int, err error) {
+	for _, q := range qualifierSplits[depth] {
+		q = strings.TrimSpace(qualifiers + " " + q)
+		rr, c, err := search(from, to, q, false)
+		if err == errTooManyResults {
+			if depth+1 < len(qualifierSplits) {
+				rr, c, err = searchSplit(from, to, q, depth+1)
+			} else {
+				rr, c, err = searchBothEnds(from, to, q)
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, rr...)
+		count += c
+	}
+	return records, count, nil
+}
+
+// searchBothEnds lists the users in [from, to) matching qualifiers, which has
+// more than 1000 users, as the first 1000 and the last 1000 by join date.
+// Users not found either way are counted in unlisted. That's at least the
+// ones past the first 2000, but users created in the same second are not
+// guaranteed to be listed in reverse order by the second search.
+func searchBothEnds(from, to time.Time, qualifiers string) (records []record, count int, err error) {
+	listed := make(map[uint64]bool)
+	first, count, err := searchUsers(from, to, qualifiers+" sort:joined-asc", true, listed)
+	if err != nil {
+		return nil, 0, err
+	}
+	last, _, err := searchUsers(from, to, qualifiers+" sort:joined-desc", true, listed)
+	if err != nil {
+		return nil, 0, err
+	}
+	seen := make(map[record]bool)
+	for _, r := range append(first, last...) {
+		if !seen[r] {
+			seen[r] = true
+			records = append(records, r)
+		}
+	}
+	if n := count - len(listed); n > 0 {
+		log.Printf("[%v to %v] %d users with %q, only %d could be listed",
+			from.Format(time.RFC3339), to.Format(time.RFC3339), count, qualifiers, len(listed))
+		unlisted.Add(int64(n))
+		usersUnlisted.Add(float64(n))
+	}
+	return records, count, nil
+}
+
+// search lists the users created in [from, to) that match the extra search
+// qualifiers, and returns their keys. If there are more than 1000, it returns
+// errTooManyResults, unless partial is set, in which case it returns the
+// keys of the first 1000.
+func search(from, to time.Time, qualifiers string, partial bool) (records []record, count int, err error) {
+	return searchUsers(from, to, qualifiers, partial, nil)
+}
+
+// searchUsers is search, and also adds the database IDs of the users it
+// listed to listed, if not nil.
+func searchUsers(from, to time.Time, qualifiers string, partial bool, listed map[uint64]bool) (records []record, count int, err error) {
 	var after string
-	var retries int
-	keys = make(map[string]uint64)
+	var truncated int
+	seen := make(map[record]bool)
 	for {
-		res, err := apiRequest(from, to, after)
+		res, err := apiRequest(from, to, qualifiers, after)
 		if err != nil {
-			if retries >= 5 {
-				return nil, 0, err
-			}
-			retries++
-			s := retries * retries * retries
-			log.Printf("API error: %v; sleeping %d seconds...", err, s)
-			time.Sleep(time.Duration(s) * time.Second)
-			continue
+			return nil, 0, err
 		}
-		retries = 0
 
-		if res.UserCount > 1000 {
+		if res.UserCount > 1000 && !partial {
 			return nil, res.UserCount, errTooManyResults
 		}
 
 		for _, user := range res.Edges {
-			for _, key := range user.Node.PublicKeys.Nodes {
-				keys[key.Key] = user.Node.DatabaseID
+			if listed != nil {
+				listed[user.Node.DatabaseID] = true
+			}
+			if user.Node.PublicKeys.PageInfo.HasNextPage {
+				truncated++
+			}
+			rr, err := user.Node.records()
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, r := range rr {
+				if !seen[r] {
+					seen[r] = true
+					records = append(records, r)
+				}
 			}
 		}
 
@@ -102,49 +475,195 @@ func search(from, to time.Time) (keys map[string]uint64, count int, err error) {
 			break
 		}
 	}
-	return keys, count, nil
+	if truncated > 0 {
+		log.Printf("[%v to %v] %d users with more than 100 keys needed extra pages",
+			from.Format(time.RFC3339), to.Format(time.RFC3339), truncated)
+	}
+	return records, count, nil
 }
 
+// records returns a record for each of the user's keys, fetching the ones
+// past the first page, and the signing keys if requested.
+func (u *userNode) records() ([]record, error) {
+	keys := u.PublicKeys.Nodes
+	if u.PublicKeys.PageInfo.HasNextPage {
+		more, err := remainingKeys(u.ID, u.PublicKeys.PageInfo.EndCursor)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, more...)
+	}
+	records := u.keyRecords(keys, kindAuthentication)
+	if *signingKeys {
+		keys, err := signingKeysOf(u)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, u.keyRecords(keys, kindSigning)...)
+	}
+	return records, nil
+}
+
+func (u *userNode) keyRecords(keys []publicKey, kind string) []record {
+	var records []record
+	for _, key := range keys {
+		records = append(records, record{Source: githubInstance.Source, ID: u.DatabaseID, Key: key.Key,
+			Kind: kind, Login: u.Login, Name: u.Name})
+	}
+	return records
+}
+
+// signingKeysOf fetches the SSH signing keys of a user from the REST API,
+// since they are not exposed over GraphQL.
+func signingKeysOf(u *userNode) ([]publicKey, error) {
+	next := githubInstance.APIURL + "/users/" + url.PathEscape(u.Login) + "/ssh_signing_keys?per_page=100"
+	var keys []publicKey
+	for next != "" {
+		var raw json.RawMessage
+		var err error
+		page := next
+		next, err = getGitHubJSON(page, &raw)
+		if err == errNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		responseArchive.write(archiveEntry{URL: page, Body: raw,
+			User: &userNode{DatabaseID: u.DatabaseID, Login: u.Login, Name: u.Name}})
+		var pageKeys []publicKey
+		if err := json.Unmarshal(raw, &pageKeys); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pageKeys...)
+	}
+	return keys, nil
+}
+
+// remainingKeys fetches the keys of the user with node ID id past the first
+// page, which ends at cursor after.
+func remainingKeys(id, after string) ([]publicKey, error) {
+	var keys []publicKey
+	for {
+		buf := &strings.Builder{}
+		keysQuery.Execute(buf, struct{ ID, After string }{ID: id, After: after})
+		var data struct {
+			Node struct {
+				PublicKeys publicKeys `json:"publicKeys"`
+			} `json:"node"`
+		}
+		if err := graphQLWithRetries(buf.String(), &data); err != nil {
+			return nil, err
+		}
+		keys = append(keys, data.Node.PublicKeys.Nodes...)
+		if !data.Node.PublicKeys.PageInfo.HasNextPage {
+			return keys, nil
+		}
+		after = data.Node.PublicKeys.PageInfo.EndCursor
+	}
+}
+
+// client is used for all API requests. Tests replace it.
 var client = &http.Client{Timeout: 5 * time.Second}
 
-var token = os.Getenv("GITHUB_TOKEN")
+var githubURL = flag.String("github-url", "https://github.com", "web URL of the GitHub instance, such as a GitHub Enterprise Server")
 
-func apiRequest(from, to time.Time, after string) (*searchResult, error) {
+// githubInstance is the -github-url instance, set by main. Records of a GitHub
+// Enterprise Server have its host name as their source. Tests replace it.
+var githubInstance = githubauth.DotCom
+
+var signingKeys = flag.Bool("signing-keys", false, "also fetch GitHub SSH signing keys, with one REST request per user")
+
+func apiRequest(from, to time.Time, qualifiers, after string) (*searchResult, error) {
+	// created: ranges are inclusive, and have a resolution of one second.
 	buf := &strings.Builder{}
 	query.Execute(buf, struct {
-		From, To, After string
-	}{From: from.Format(time.RFC3339), To: to.Format(time.RFC3339), After: after})
+		From, To, Qualifiers, After string
+	}{From: from.Format(time.RFC3339), To: to.Add(-minWindow).Format(time.RFC3339),
+		Qualifiers: qualifiers, After: after})
+
+	var data struct {
+		Search searchResult `json:"search"`
+	}
+	if err := graphQLWithRetries(buf.String(), &data); err != nil {
+		return nil, err
+	}
+	return &data.Search, nil
+}
+
+// graphQLWithRetries calls graphQL, retrying rate limited requests
+// indefinitely and other errors up to five times.
+func graphQLWithRetries(q string, v interface{}) error {
+	return withRetries(func() error { return graphQL(q, v) })
+}
+
+// graphQL runs a query against the GitHub GraphQL API with the next available
+// credential, pacing it with the credential's limiter, and decodes the data
+// into v. Queries should request the rateLimit object, which is used to pace
+// the following requests.
+func graphQL(q string, v interface{}) error {
+	c := githubTokens.acquire(graphQLLimiter)
+	auth, err := c.authorization()
+	if err != nil {
+		return err
+	}
+
 	body, _ := json.Marshal(struct {
 		Query string `json:"query"`
-	}{Query: buf.String()})
-
-	r, _ := http.NewRequest("POST", "https://api.github.com/graphql", bytes.NewReader(body))
-	r.Header.Set("Authorization", "bearer "+token)
+	}{Query: q})
+	r, _ := http.NewRequest("POST", githubInstance.GraphQLURL, bytes.NewReader(body))
+	r.Header.Set("Authorization", auth)
 	res, err := client.Do(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer res.Body.Close()
+	body, err = io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if err := c.graphQL.check(res, body); err != nil {
+		return err
+	}
 
 	out := &response{}
-	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
-		return nil, err
+	if err := json.Unmarshal(body, out); err != nil {
+		return err
 	}
-	if len(out.Errors) > 0 {
-		return nil, fmt.Errorf("GraphQL error %q", out.Errors[0].Message)
+	if out.Data.RateLimit != nil {
+		c.graphQL.update(out.Data.RateLimit)
+	}
+	for _, e := range out.Errors {
+		switch e.Type {
+		case "NOT_FOUND":
+			// Deleted or renamed users resolve to null in the data.
+			log.Printf("GraphQL: %s", e.Message)
+		case "RATE_LIMITED":
+			return c.graphQL.pauseForReset()
+		default:
+			return fmt.Errorf("GraphQL error %q", e.Message)
+		}
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP status %q", res.Status)
+		return fmt.Errorf("HTTP status %q", res.Status)
 	}
 
-	return &out.Data.Search, nil
+	responseArchive.write(archiveEntry{Query: q, Body: body})
+	return json.Unmarshal(body, &struct {
+		Data interface{} `json:"data"`
+	}{v})
 }
 
 var query = template.Must(template.New("query").Parse(`
 {
+	rateLimit {
+		cost
+		remaining
+		resetAt
+	}
 	search(
 		type: USER
-		query: "type:user created:{{ .From }}..{{ .To }}"
+		query: "type:user created:{{ .From }}..{{ .To }}{{ if .Qualifiers }} {{ .Qualifiers }}{{ end }}"
 		first: 100
 		{{ if .After }}after: "{{ .After }}"{{ end }}
 	) {
@@ -156,8 +675,15 @@ var query = template.Must(template.New("query").Parse(`
 		edges {
 			node {
 				... on User {
+					id
 					databaseId
+					login
+					name
 					publicKeys(first: 100) {
+						pageInfo {
+							hasNextPage
+							endCursor
+						}
 						nodes {
 							key
 						}
@@ -169,6 +695,32 @@ var query = template.Must(template.New("query").Parse(`
 }
 `))
 
+var keysQuery = template.Must(template.New("keysQuery").Parse(`
+{
+	rateLimit {
+		cost
+		remaining
+		resetAt
+	}
+	node(id: "{{ .ID }}") {
+		... on User {
+			databaseId
+			login
+			name
+			publicKeys(first: 100, after: "{{ .After }}") {
+				pageInfo {
+					hasNextPage
+					endCursor
+				}
+				nodes {
+					key
+				}
+			}
+		}
+	}
+}
+`))
+
 type searchResult struct {
 	UserCount int `json:"userCount"`
 	PageInfo  struct {
@@ -176,22 +728,36 @@ type searchResult struct {
 		EndCursor   string `json:"endCursor"`
 	} `json:"pageInfo"`
 	Edges []struct {
-		Node struct {
-			DatabaseID uint64 `json:"databaseId"`
-			PublicKeys struct {
-				Nodes []struct {
-					Key string `json:"key"`
-				} `json:"nodes"`
-			} `json:"publicKeys"`
-		} `json:"node"`
+		Node userNode `json:"node"`
 	} `json:"edges"`
 }
 
+type userNode struct {
+	ID         string     `json:"id"`
+	DatabaseID uint64     `json:"databaseId"`
+	Login      string     `json:"login"`
+	Name       string     `json:"name"`
+	PublicKeys publicKeys `json:"publicKeys"`
+}
+
+type publicKeys struct {
+	PageInfo struct {
+		HasNextPage bool   `json:"hasNextPage"`
+		EndCursor   string `json:"endCursor"`
+	} `json:"pageInfo"`
+	Nodes []publicKey `json:"nodes"`
+}
+
+type publicKey struct {
+	Key string `json:"key"`
+}
+
 type response struct {
 	Data struct {
-		Search searchResult `json:"search"`
+		RateLimit *rateLimit `json:"rateLimit"`
 	} `json:"data"`
 	Errors []struct {
+		Type    string `json:"type"`
 		Message string `json:"message"`
 	} `json:"errors"`
 }
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// crawl runs a GitHub crawl of [start, until) split across the given number
+// of workers, and returns the emitted records.
+func crawl(t *testing.T, start, until time.Time, workers int) []record {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	cp := &checkpoint{Source: "github", Partitions: partitionRange(start, until, workers)}
+	crawlGitHub(cp, &output{enc: json.NewEncoder(buf)}, nil)
+	return decodeRecords(t, buf)
+}
+
+func decodeRecords(t *testing.T, r io.Reader) []record {
+	t.Helper()
+	var records []record
+	d := json.NewDecoder(r)
+	for d.More() {
+		var r record
+		if err := d.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// checkKeys checks that records has every key of users exactly once.
+func checkKeys(t *testing.T, users []*fakeUser, records []record) {
+	t.Helper()
+	want := make(map[record]bool)
+	for _, u := range users {
+		if u.Org {
+			continue
+		}
+		for _, k := range u.Keys {
+			want[record{Source: "github", ID: u.ID, Key: k, Kind: kindAuthentication, Login: u.login()}] = true
+		}
+		for _, k := range u.Signing {
+			want[record{Source: "github", ID: u.ID, Key: k, Kind: kindSigning, Login: u.login()}] = true
+		}
+	}
+	for _, r := range records {
+		if !want[r] {
+			t.Errorf("unexpected or duplicate record %+v", r)
+		}
+		delete(want, r)
+	}
+	if len(want) > 0 {
+		t.Errorf("%d records missing", len(want))
+	}
+}
+
+func TestCrawlDenseWindow(t *testing.T) {
+	burst := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var users []*fakeUser
+	for i := 0; i < 500; i++ {
+		users = append(users, &fakeUser{ID: uint64(len(users) + 1),
+			Created: burst.Add(-time.Duration(i) * 3 * time.Minute)})
+	}
+	// 3000 users in the same second, more than 1000 of which with no repos.
+	for i := 0; i < 3000; i++ {
+		u := &fakeUser{ID: uint64(len(users) + 1), Created: burst,
+			Repos: i % 40, Followers: i % 6}
+		if i%3 == 0 {
+			u.Repos = 0
+		}
+		users = append(users, u)
+	}
+	for _, u := range users {
+		u.Keys = []string{fmt.Sprintf("ssh-ed25519 KEY%d", u.ID)}
+	}
+	newFakeGitHub(t, users)
+
+	records := crawl(t, burst.Add(-48*time.Hour), burst.Add(time.Hour), 1)
+	checkKeys(t, users, records)
+}
+
+func TestCrawlUnsplittableWindow(t *testing.T) {
+	burst := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		n             int
+		unorderedTies bool
+		listed        func(users []*fakeUser) []*fakeUser
+	}{
+		{1200, false, func(users []*fakeUser) []*fakeUser { return users }},
+		// Only the first and last 1000 users can be listed.
+		{2500, false, func(users []*fakeUser) []*fakeUser {
+			return append(users[:1000:1000], users[len(users)-1000:]...)
+		}},
+		// If the two searches don't list ties in opposite orders, they can
+		// overlap even if there are fewer than 2000 users.
+		{1200, true, func(users []*fakeUser) []*fakeUser { return users[:1000] }},
+	} {
+		var users []*fakeUser
+		for i := 0; i < tt.n; i++ {
+			users = append(users, &fakeUser{ID: uint64(i + 1), Created: burst,
+				Keys: []string{fmt.Sprintf("ssh-ed25519 KEY%d", i+1)}})
+		}
+		f := newFakeGitHub(t, users)
+		f.unorderedTies = tt.unorderedTies
+		listed := tt.listed(users)
+		unlistedBefore := unlisted.Load()
+		metricBefore := testutil.ToFloat64(usersUnlisted)
+
+		done := make(chan []record)
+		go func() { done <- crawl(t, burst.Add(-time.Hour), burst.Add(time.Hour), 1) }()
+		select {
+		case records := <-done:
+			checkKeys(t, listed, records)
+		case <-time.After(10 * time.Second):
+			t.Fatal("crawl did not terminate")
+		}
+		want := int64(tt.n - len(listed))
+		if got := unlisted.Load() - unlistedBefore; got != want {
+			t.Errorf("%d users: %d counted as unlisted, want %d", tt.n, got, want)
+		}
+		if got := testutil.ToFloat64(usersUnlisted) - metricBefore; got != float64(want) {
+			t.Errorf("%d users: unlisted metric grew by %v, want %d", tt.n, got, want)
+		}
+	}
+}
+
+// recordCollector is an io.Writer that decodes the records written to it by
+// an output, which can be used concurrently with a running crawl.
+type recordCollector struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (c *recordCollector) Write(p []byte) (int, error) {
+	var r record
+	if err := json.Unmarshal(p, &r); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, r)
+	return len(p), nil
+}
+
+// waitFor waits for the records of every key of users to be written.
+func (c *recordCollector) waitFor(t *testing.T, users ...*fakeUser) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		keys := make(map[string]bool)
+		for _, r := range c.records {
+			keys[r.Key] = true
+		}
+		c.mu.Unlock()
+		missing := 0
+		for _, u := range users {
+			for _, k := range u.Keys {
+				if !keys[k] {
+					missing++
+				}
+			}
+		}
+		if missing == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d keys were not crawled", missing)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// unique returns the records, without the ones crawled again.
+func (c *recordCollector) unique() []record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[record]bool)
+	var records []record
+	for _, r := range c.records {
+		if !seen[r] {
+			seen[r] = true
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func TestCrawlFollow(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	rng := rand.New(rand.NewSource(1))
+	var users []*fakeUser
+	newUser := func(created time.Time) *fakeUser {
+		u := &fakeUser{ID: uint64(len(users) + 1), Created: created}
+		u.Keys = []string{fmt.Sprintf("ssh-ed25519 KEY%d", u.ID)}
+		users = append(users, u)
+		return u
+	}
+	for i := 0; i < 500; i++ {
+		newUser(now.Add(-time.Duration(rng.Int63n(int64(30 * 24 * time.Hour)))).Truncate(time.Second))
+	}
+	f := newFakeGitHub(t, users)
+	oldFollow, oldOverlap := *follow, *overlap
+	*follow, *overlap = 10*time.Millisecond, time.Hour
+	t.Cleanup(func() { *follow, *overlap = oldFollow, oldOverlap })
+
+	// Crawl up to a few hours ago. The sparse users make the windows grow
+	// to days, and the first follow pass has more than the overlap to cover.
+	c := &recordCollector{}
+	out := &output{enc: json.NewEncoder(c)}
+	cp := &checkpoint{Source: "github", Partitions: partitionRange(now.AddDate(0, 0, -60), now.Add(-3*time.Hour), 1)}
+	crawlGitHub(cp, out, nil)
+	checkKeys(t, users, c.unique())
+	latest := cp.Partitions[0].End
+	if cp.Partitions[0].Window <= *overlap {
+		t.Fatalf("the crawl ended with a window of %v, want more than the overlap", cp.Partitions[0].Window)
+	}
+	f.mu.Lock()
+	initialWindows := len(f.windows)
+	f.mu.Unlock()
+
+	// A user indexed late, within the overlap, and one created after the
+	// crawl are found by the first passes.
+	late, fresh := newUser(latest.Add(-30*time.Minute)), newUser(latest.Add(time.Hour))
+	f.addUsers(late, fresh)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		followGitHub(cp, out, stop)
+		close(done)
+	}()
+	c.waitFor(t, late, fresh)
+
+	// A user who signs up between passes is found by a later one.
+	newer := newUser(time.Now().Truncate(time.Second))
+	f.addUsers(newer)
+	c.waitFor(t, newer)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("followGitHub did not stop")
+	}
+	checkKeys(t, users, c.unique())
+	if n := testutil.CollectAndCount(positionTime); n != 1 {
+		t.Errorf("position metric has %d series after following, want 1", n)
+	}
+
+	// Every pass restarts from the overlap before the end of the previous
+	// one, with a window no larger than the overlap.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	windows := f.windows[initialWindows:]
+	if len(windows) == 0 {
+		t.Fatal("no follow pass searched")
+	}
+	if first := windows[0]; !first.from.Equal(latest.Add(-*overlap)) || first.to.Sub(first.from) > *overlap {
+		t.Errorf("first follow window is %v to %v, want to start at %v and span at most %v",
+			first.from, first.to, latest.Add(-*overlap), *overlap)
+	}
+	passes := 0
+	for i, w := range windows {
+		if i > 0 && !w.from.Before(windows[i-1].to) {
+			continue
+		}
+		passes++
+		if w.from.Before(latest.Add(-*overlap)) {
+			t.Errorf("follow pass %d starts at %v, before the overlap of the first", passes, w.from)
+		}
+		if w.to.Sub(w.from) > *overlap {
+			t.Errorf("follow pass %d starts with a window of %v", passes, w.to.Sub(w.from))
+		}
+	}
+	if passes < 2 {
+		t.Errorf("%d follow passes, want at least 2", passes)
+	}
+}
+
+// stopAfter is an io.Writer that closes stop once n records were written.
+type stopAfter struct {
+	w    io.Writer
+	n    int
+	stop chan struct{}
+}
+
+func (s *stopAfter) Write(p []byte) (int, error) {
+	if s.n--; s.n == 0 {
+		close(s.stop)
+	}
+	return s.w.Write(p)
+}
+
+func TestCrawlResume(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := start.AddDate(1, 0, 0)
+	users := randomUsers(start)
+	newFakeGitHub(t, users)
+	oldPath := *checkpointPath
+	*checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+	t.Cleanup(func() { *checkpointPath = oldPath })
+
+	// Interrupt the crawl partway, like a Ctrl-C.
+	buf := &bytes.Buffer{}
+	stop := make(chan struct{})
+	cp := &checkpoint{Source: "github", Partitions: partitionRange(start, until, 3)}
+	crawlGitHub(cp, &output{enc: json.NewEncoder(&stopAfter{w: buf, n: 2000, stop: stop})}, stop)
+	first := decodeRecords(t, buf)
+
+	cp, err := loadCheckpoint(*checkpointPath, "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Partitions) != 3 {
+		t.Fatalf("checkpoint has %d partitions, want 3", len(cp.Partitions))
+	}
+	for _, p := range cp.Partitions {
+		if p.End.Before(p.Start) || p.End.After(p.Until) {
+			t.Errorf("partition %v to %v checkpointed at %v", p.Start, p.Until, p.End)
+		}
+	}
+	done, total := cp.progress()
+	if done == 0 || done >= total {
+		t.Fatalf("interrupted crawl checkpointed %v of %v", done, total)
+	}
+
+	buf.Reset()
+	crawlGitHub(cp, &output{enc: json.NewEncoder(buf)}, nil)
+	second := decodeRecords(t, buf)
+	if len(second) == 0 {
+		t.Errorf("resumed crawl emitted no records")
+	}
+	checkKeys(t, users, append(first, second...))
+}
+
+func TestCrawlTokenFailover(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := randomUsers(start)[:3000]
+	f := newFakeGitHub(t, users)
+	f.setTokens("a", "b", "c")
+	f.quota = map[string]int{"a": 5, "b": 1000000, "c": 0}
+
+	const workers = 2
+	done := make(chan []record)
+	go func() { done <- crawl(t, start, start.AddDate(1, 0, 0), workers) }()
+	select {
+	case records := <-done:
+		checkKeys(t, users, records)
+	case <-time.After(10 * time.Second):
+		t.Fatal("crawl did not fail over to the token with quota left")
+	}
+	// Each worker can pick a token before another one's request exhausts it.
+	f.mu.Lock()
+	a, c := f.byToken["a"], f.byToken["c"]
+	f.mu.Unlock()
+	if a < 6 || a > 5+workers || c < 1 || c > workers {
+		t.Errorf("exhausted tokens were used %d and %d times, want 6 to %d and 1 to %d", a, c, 5+workers, workers)
+	}
+}
+
+func TestPartitionRange(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10*time.Hour + 5*time.Second + 700*time.Millisecond)
+	partitions := partitionRange(start, end, 3)
+	next := start
+	for _, p := range partitions {
+		if !p.Start.Equal(next) || !p.End.Equal(p.Start) {
+			t.Errorf("partition %v to %v does not start at %v", p.Start, p.Until, next)
+		}
+		if !p.Until.Equal(p.Until.Truncate(minWindow)) {
+			t.Errorf("partition %v to %v does not end on a whole second", p.Start, p.Until)
+		}
+		next = p.Until
+	}
+	if want := end.Truncate(minWindow); !next.Equal(want) {
+		t.Errorf("partitions end at %v, want %v", next, want)
+	}
+}
+
+func TestCrawlIDs(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := randomUsers(start)[:1500]
+	for _, u := range users {
+		u.Org = u.ID%10 == 0
+	}
+	f := newFakeGitHub(t, users)
+	f.failEvery = 7
+
+	buf := &bytes.Buffer{}
+	cp := &checkpoint{Source: "github-ids", Cursor: "200"}
+	crawlGitHubIDs(cp, &output{enc: json.NewEncoder(buf)}, nil)
+	var want []*fakeUser
+	for _, u := range users {
+		if u.ID > 200 {
+			want = append(want, u)
+		}
+	}
+	checkKeys(t, want, decodeRecords(t, buf))
+	if cp.Cursor != "1500" {
+		t.Errorf("crawl ended at ID %s, want 1500", cp.Cursor)
+	}
+	if pos := testutil.ToFloat64(positionID); pos != 1500 {
+		t.Errorf("position metric is %v, want 1500", pos)
+	}
+}
+
+func TestCrawlUsers(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := randomUsers(start)[:200]
+	f := newFakeGitHub(t, users)
+	byID := func(id uint64) *fakeUser {
+		for _, u := range f.users {
+			if u.ID == id {
+				return u
+			}
+		}
+		t.Fatalf("no user %d", id)
+		return nil
+	}
+	byID(30).Login = "12345" // logins can be all digits
+	byID(30).Keys = []string{"ssh-ed25519 KEY30-digits"}
+	byID(40).Org = true
+
+	lines := []string{"# comment", "12345", "id:7", "", "user8", "id:40", "nosuchuser", "id:99999"}
+	for id := 100; id < 160; id++ {
+		lines = append(lines, fmt.Sprintf("id:%d", id))
+	}
+	path := filepath.Join(t.TempDir(), "users.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	crawlUsers(path, &output{enc: json.NewEncoder(buf)}, nil)
+	want := []*fakeUser{byID(7), byID(8), byID(30)}
+	for id := uint64(100); id < 160; id++ {
+		want = append(want, byID(id))
+	}
+	checkKeys(t, want, decodeRecords(t, buf))
+}
+
+func TestCrawlSigningKeys(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := randomUsers(start)[:2000]
+	for _, u := range users {
+		switch {
+		case u.ID%5 == 0 && len(u.Keys) > 0:
+			u.Signing = []string{u.Keys[0]} // registered as both kinds
+		case u.ID%7 == 0:
+			u.Signing = []string{fmt.Sprintf("ssh-ed25519 SIGNING%d", u.ID)}
+		}
+	}
+	for i := 0; i < 150; i++ {
+		users[0].Signing = append(users[0].Signing, fmt.Sprintf("ssh-ed25519 SIGNING%d-%d", users[0].ID, i))
+	}
+	f := newFakeGitHub(t, users)
+	f.failEvery = 13
+	oldSigning := *signingKeys
+	*signingKeys = true
+	t.Cleanup(func() { *signingKeys = oldSigning })
+
+	path := filepath.Join(t.TempDir(), "archive.jsonl.gz")
+	a, err := openArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldArchive := responseArchive
+	responseArchive = a
+	t.Cleanup(func() { responseArchive = oldArchive })
+	crawled := crawl(t, start, start.AddDate(1, 0, 0), 2)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	responseArchive = oldArchive
+	checkKeys(t, users, crawled)
+
+	buf := &bytes.Buffer{}
+	if err := replay(path, &output{enc: json.NewEncoder(buf)}); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[record]bool)
+	var replayed []record
+	for _, r := range decodeRecords(t, buf) {
+		if !seen[r] {
+			seen[r] = true
+			replayed = append(replayed, r)
+		}
+	}
+	checkKeys(t, users, replayed)
+}
+
+// randomUsers generates users created over a year, mostly spread out but with
+// some bursts, with zero to a few hundred keys each.
+func randomUsers(start time.Time) []*fakeUser {
+	rng := rand.New(rand.NewSource(1))
+	var users []*fakeUser
+	add := func(created time.Time) {
+		u := &fakeUser{ID: uint64(len(users) + 1), Created: created,
+			Repos: rng.Intn(50), Followers: rng.Intn(10)}
+		n := rng.Intn(4)
+		if rng.Intn(100) == 0 {
+			n = 100 + rng.Intn(150)
+		}
+		for i := 0; i < n; i++ {
+			u.Keys = append(u.Keys, fmt.Sprintf("ssh-ed25519 KEY%d-%d", u.ID, i))
+		}
+		users = append(users, u)
+	}
+	year := 365 * 24 * time.Hour
+	for i := 0; i < 5000; i++ {
+		add(start.Add(time.Duration(rng.Int63n(int64(year)))).Truncate(time.Second))
+	}
+	for i := 0; i < 5; i++ {
+		burst := start.Add(time.Duration(rng.Int63n(int64(year)))).Truncate(time.Second)
+		for j := 0; j < 1500; j++ {
+			add(burst.Add(time.Duration(rng.Intn(120)) * time.Second))
+		}
+	}
+	return users
+}
+
+func TestCrawl(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := start.AddDate(1, 0, 0)
+	users := randomUsers(start)
+	f := newFakeGitHub(t, users)
+	f.failEvery, f.rateLimitEvery = 7, 11
+	retriesBefore := testutil.ToFloat64(apiRetries)
+
+	records := crawl(t, start, until, 3)
+	checkKeys(t, users, records)
+	if testutil.ToFloat64(apiRetries) == retriesBefore {
+		t.Errorf("no retry was counted")
+	}
+	if n := testutil.CollectAndCount(positionTime); n != 3 {
+		t.Errorf("position metric has %d series, want one per partition", n)
+	}
+	if pos := testutil.ToFloat64(positionTime.WithLabelValues("2")); pos != float64(until.Unix()) {
+		t.Errorf("position of the last partition is %v, want %v", pos, until.Unix())
+	}
+
+	// The accepted windows must tile [start, until) without gaps or overlaps.
+	// Windows searched more than once because of retries are deduplicated.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[fakeWindow]bool)
+	var windows []fakeWindow
+	for _, w := range f.windows {
+		if w.count > 1000 && w.to.Sub(w.from) > minWindow {
+			continue // shrunk
+		}
+		if !seen[w] {
+			seen[w] = true
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].from.Before(windows[j].from) })
+	next := start
+	for _, w := range windows {
+		if !w.from.Equal(next) {
+			t.Fatalf("window %v to %v does not start at %v", w.from, w.to, next)
+		}
+		next = w.to
+	}
+	if !next.Equal(until) {
+		t.Errorf("windows end at %v, want %v", next, until)
+	}
+	if f.limited == 0 {
+		t.Errorf("no rate limit was injected")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := randomUsers(start)[:2000]
+	newFakeGitHub(t, users)
+
+	path := filepath.Join(t.TempDir(), "archive.jsonl.gz")
+	a, err := openArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldArchive := responseArchive
+	responseArchive = a
+	t.Cleanup(func() { responseArchive = oldArchive })
+	crawled := crawl(t, start, start.AddDate(1, 0, 0), 2)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	responseArchive = oldArchive
+
+	buf := &bytes.Buffer{}
+	if err := replay(path, &output{enc: json.NewEncoder(buf)}); err != nil {
+		t.Fatal(err)
+	}
+	// Windows shrunk after a full first page are replayed twice.
+	seen := make(map[record]bool)
+	var replayed []record
+	for _, r := range decodeRecords(t, buf) {
+		if !seen[r] {
+			seen[r] = true
+			replayed = append(replayed, r)
+		}
+	}
+	checkKeys(t, users, crawled)
+	checkKeys(t, users, replayed)
+}
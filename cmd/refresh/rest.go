@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+// retryBackoff returns how long to wait before retry number n of a failed
+// request. Tests replace it.
+var retryBackoff = func(n int) time.Duration {
+	return time.Duration(n*n*n) * time.Second
+}
+
+// withRetries calls f until it succeeds. Rate limited calls are retried
+// indefinitely, since the limiter already holds off the next one, and other
+// errors up to five times. errNotFound is returned immediately.
+func withRetries(f func() error) error {
+	var retries int
+	for {
+		err := f()
+		if err == nil || err == errNotFound {
+			return err
+		}
+		var rlErr *rateLimitError
+		if errors.As(err, &rlErr) {
+			apiErrors.WithLabelValues("true").Inc()
+			continue
+		}
+		apiErrors.WithLabelValues("false").Inc()
+		if retries >= 5 {
+			return err
+		}
+		retries++
+		apiRetries.Inc()
+		d := retryBackoff(retries)
+		log.Printf("API error: %v; sleeping %v...", err, d)
+		time.Sleep(d)
+	}
+}
+
+// getJSON fetches url into v, retrying transient errors, and returns the
+// rel="next" URL from the Link header, if any. If l is not nil, requests are
+// paced by it, and GitHub rate limit responses are retried after a pause.
+func getJSON(l *limiter, url string, header http.Header, v interface{}) (next string, err error) {
+	err = withRetries(func() error {
+		if l != nil {
+			l.wait()
+		}
+		next, err = getJSONOnce(l, url, header, v)
+		return err
+	})
+	return next, err
+}
+
+// getJSONOnce makes a single request, after a slot was reserved on l, if any.
+func getJSONOnce(l *limiter, url string, header http.Header, v interface{}) (next string, err error) {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	res, err := client.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if l != nil {
+		if err := l.check(res, body); err != nil {
+			return "", err
+		}
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return "", errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP status %q", res.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", err
+	}
+	return nextLink(res.Header.Get("Link")), nil
+}
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+func nextLink(link string) string {
+	if m := linkNextRe.FindStringSubmatch(link); m != nil {
+		return m[1]
+	}
+	return ""
+}
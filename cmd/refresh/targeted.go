@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var usersFile = flag.String("users", "", "file of GitHub logins, or database IDs prefixed by \"id:\", one per line, to refresh instead of crawling")
+
+// usersPerQuery is how many users are fetched by each targeted query.
+const usersPerQuery = 50
+
+// crawlUsers fetches the keys of the GitHub users listed in the file at path,
+// by login or by database ID, in batches of usersPerQuery. Logins can be all
+// digits, so database IDs are written as "id:12345".
+func crawlUsers(path string, out *output, stop <-chan struct{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var batch []string
+	var users, keys int
+	flush := func() {
+		records, n, err := fetchUsers(batch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.write(records)
+		users += n
+		keys += len(records)
+		usersCrawled.Add(float64(n))
+		keysCrawled.Add(float64(len(records)))
+		log.Printf("[%s to %s] %d of %d users found, got %d keys",
+			batch[0], batch[len(batch)-1], n, len(batch), len(records))
+		batch = batch[:0]
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		batch = append(batch, line)
+		if len(batch) == usersPerQuery {
+			flush()
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	log.Printf("Done: %d users, %d keys", users, keys)
+}
+
+// fetchUsers fetches the keys of the given users, which are logins or
+// database IDs prefixed by "id:", and returns them along with how many users
+// were found.
+func fetchUsers(users []string) ([]record, int, error) {
+	var logins, nodeIDs []string
+	for _, u := range users {
+		if !strings.HasPrefix(u, "id:") {
+			logins = append(logins, u)
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(u, "id:"), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid user %q: %v", u, err)
+		}
+		nodeIDs = append(nodeIDs, legacyUserNodeID(id))
+	}
+
+	buf := &strings.Builder{}
+	if err := usersQuery.Execute(buf, struct {
+		Logins, NodeIDs []string
+	}{logins, nodeIDs}); err != nil {
+		return nil, 0, err
+	}
+	var data map[string]json.RawMessage
+	if err := graphQLWithRetries(buf.String(), &data); err != nil {
+		return nil, 0, err
+	}
+
+	var nodes []*userNode
+	for i := range logins {
+		var u *userNode
+		if err := json.Unmarshal(data[fmt.Sprintf("u%d", i)], &u); err != nil {
+			return nil, 0, err
+		}
+		nodes = append(nodes, u)
+	}
+	if len(nodeIDs) > 0 {
+		var nn []*userNode
+		if err := json.Unmarshal(data["nodes"], &nn); err != nil {
+			return nil, 0, err
+		}
+		nodes = append(nodes, nn...)
+	}
+
+	var records []record
+	var found int
+	for _, u := range nodes {
+		if u == nil || u.DatabaseID == 0 {
+			continue // not found, or not a user
+		}
+		found++
+		rr, err := u.records()
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, rr...)
+	}
+	return records, found, nil
+}
+
+// legacyUserNodeID returns the legacy GraphQL global ID of the user with the
+// given database ID, which the API still resolves.
+func legacyUserNodeID(id uint64) string {
+	return base64.StdEncoding.EncodeToString([]byte("04:User" + strconv.FormatUint(id, 10)))
+}
+
+var usersQuery = template.Must(template.New("usersQuery").Parse(`
+{
+	rateLimit {
+		cost
+		remaining
+		resetAt
+	}
+	{{- range $i, $login := .Logins }}
+	u{{ $i }}: user(login: {{ printf "%q" $login }}) {
+		...userFields
+	}
+	{{- end }}
+	{{- if .NodeIDs }}
+	nodes(ids: [{{ range $i, $id := .NodeIDs }}{{ if $i }}, {{ end }}"{{ $id }}"{{ end }}]) {
+		...userFields
+	}
+	{{- end }}
+}
+
+fragment userFields on User {
+	id
+	databaseId
+	login
+	name
+	publicKeys(first: 100) {
+		pageInfo {
+			hasNextPage
+			endCursor
+		}
+		nodes {
+			key
+		}
+	}
+}
+`))
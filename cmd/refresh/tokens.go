@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/githubauth"
+)
+
+// githubTokens are the credentials GitHub requests are spread across. They are
+// loaded from the environment by main. Tests replace them.
+var githubTokens *tokenPool
+
+// A credential is a GitHub token source, with the separate GraphQL and REST
+// rate limits of the account or App installation it belongs to.
+type credential struct {
+	githubauth.Credential
+	graphQL, rest *limiter
+}
+
+// authorization returns the Authorization header value for a request.
+func (c *credential) authorization() (string, error) {
+	t, err := c.Token()
+	if err != nil {
+		return "", err
+	}
+	return "bearer " + t.AccessToken, nil
+}
+
+// A tokenPool rotates requests across credentials, skipping the ones that are
+// paused by a rate limit, so that the crawl fails over to the next credential
+// when one exhausts its quota.
+type tokenPool struct {
+	mu    sync.Mutex
+	creds []*credential
+	next  int
+}
+
+func newTokenPool(creds []githubauth.Credential) (*tokenPool, error) {
+	if len(creds) == 0 {
+		return nil, errors.New("no GitHub credentials: set GITHUB_TOKEN or GITHUB_APP_ID")
+	}
+	p := &tokenPool{}
+	for _, c := range creds {
+		p.creds = append(p.creds, &credential{Credential: c,
+			graphQL: &limiter{name: c.Name + " GraphQL", interval: githubInterval},
+			rest:    &limiter{name: c.Name + " REST", interval: &githubRESTInterval}})
+	}
+	return p, nil
+}
+
+func graphQLLimiter(c *credential) *limiter { return c.graphQL }
+func restLimiter(c *credential) *limiter    { return c.rest }
+
+// acquire returns a credential with a request slot reserved on the limiter
+// selected by l. It prefers the next credential in rotation that is not
+// paused, and if they all are, it waits for the one that resumes first.
+func (p *tokenPool) acquire(l func(*credential) *limiter) *credential {
+	for {
+		c, ok := p.pick(l)
+		if !ok {
+			l(c).wait()
+			return c
+		}
+		if l(c).reserve() {
+			return c
+		}
+	}
+}
+
+// pick returns the next credential in rotation that is not paused, or if
+// there is none, the one that resumes first and false.
+func (p *tokenPool) pick(l func(*credential) *limiter) (*credential, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var first *credential
+	for i := range p.creds {
+		c := p.creds[(p.next+i)%len(p.creds)]
+		paused := l(c).pausedUntil()
+		if !paused.After(now) {
+			p.next = (p.next + i + 1) % len(p.creds)
+			return c, true
+		}
+		if first == nil || paused.Before(l(first).pausedUntil()) {
+			first = c
+		}
+	}
+	return first, false
+}
+
+// remaining returns the last known GraphQL quota left across all credentials.
+func (p *tokenPool) remaining() int {
+	var n int
+	for _, c := range p.creds {
+		n += c.graphQL.remaining()
+	}
+	return n
+}
+
+// getGitHubJSON is getJSON for the GitHub REST API. Each attempt uses the
+// next available credential, so a rate limited request is retried with
+// another one.
+func getGitHubJSON(url string, v interface{}) (next string, err error) {
+	err = withRetries(func() error {
+		c := githubTokens.acquire(restLimiter)
+		auth, err := c.authorization()
+		if err != nil {
+			return err
+		}
+		next, err = getJSONOnce(c.rest, url, http.Header{"Authorization": {auth}}, v)
+		return err
+	})
+	return next, err
+}
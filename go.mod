@@ -5,6 +5,7 @@ go 1.19
 require (
 	crawshaw.io/sqlite v0.3.2
 	github.com/google/go-github/v42 v42.0.0
+	github.com/klauspost/compress v1.15.13
 	github.com/prometheus/client_golang v1.14.0
 	golang.org/x/crypto v0.4.0
 	golang.org/x/oauth2 v0.3.0
@@ -13,6 +14,7 @@ require (
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
@@ -0,0 +1,211 @@
+// Package githubauth provides the GitHub API endpoints and credentials shared
+// by the server and cmd/refresh: github.com or a GitHub Enterprise Server,
+// personal access tokens, and GitHub App installation tokens which are minted
+// on demand and refreshed before they expire.
+package githubauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// A Credential is a named source of GitHub API tokens. Each credential has
+// its own rate limits.
+type Credential struct {
+	Name string
+	oauth2.TokenSource
+}
+
+// FromEnv returns the credentials configured in the environment:
+//
+//   - GITHUB_TOKEN, a comma-separated list of personal access tokens, and
+//   - GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY,
+//     a GitHub App with one or more comma-separated installations, and its
+//     PEM-encoded private key.
+//
+// Installation tokens are requested from the API at apiURL with client.
+// No credentials is not an error.
+func FromEnv(client *http.Client, apiURL string) ([]Credential, error) {
+	var creds []Credential
+	for i, t := range strings.Split(os.Getenv("GITHUB_TOKEN"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		creds = append(creds, Credential{Name: fmt.Sprintf("token %d", i+1),
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: t})})
+	}
+
+	appID := os.Getenv("GITHUB_APP_ID")
+	if appID == "" {
+		return creds, nil
+	}
+	id, err := strconv.ParseInt(appID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_ID: %v", err)
+	}
+	key, err := ParsePrivateKey([]byte(os.Getenv("GITHUB_APP_PRIVATE_KEY")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_PRIVATE_KEY: %v", err)
+	}
+	installations := os.Getenv("GITHUB_APP_INSTALLATION_ID")
+	if installations == "" {
+		return nil, errors.New("GITHUB_APP_ID requires GITHUB_APP_INSTALLATION_ID")
+	}
+	for _, s := range strings.Split(installations, ",") {
+		inst, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITHUB_APP_INSTALLATION_ID: %v", err)
+		}
+		creds = append(creds, Credential{Name: fmt.Sprintf("app %d installation %d", id, inst),
+			TokenSource: AppInstallation(client, apiURL, id, inst, key)})
+	}
+	return creds, nil
+}
+
+// ParsePrivateKey parses a PEM-encoded RSA private key, in the PKCS #1 form
+// GitHub generates for Apps, or in PKCS #8 form.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", k)
+	}
+	return rsaKey, nil
+}
+
+// AppInstallation returns a TokenSource of installation access tokens for the
+// given App installation. Tokens are reused until shortly before they expire,
+// which is one hour after they are minted.
+func AppInstallation(client *http.Client, apiURL string, appID, installationID int64, key *rsa.PrivateKey) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &appTokenSource{client: client,
+		url:   fmt.Sprintf("%s/app/installations/%d/access_tokens", strings.TrimSuffix(apiURL, "/"), installationID),
+		appID: appID, key: key})
+}
+
+type appTokenSource struct {
+	client *http.Client
+	url    string
+	appID  int64
+	key    *rsa.PrivateKey
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+jwt)
+	r.Header.Set("Accept", "application/vnd.github+json")
+	res, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("minting installation token: HTTP status %q: %s", res.Status, bytes.TrimSpace(body))
+	}
+	var t struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: t.Token, Expiry: t.ExpiresAt}, nil
+}
+
+// jwt returns a JSON Web Token authenticating as the App, valid for a few
+// minutes around now to allow for clock drift.
+//
+// See https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app.
+func (s *appTokenSource) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}{now.Add(-1 * time.Minute).Unix(), now.Add(9 * time.Minute).Unix(), strconv.FormatInt(s.appID, 10)})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// NewClient returns an HTTP client that authenticates each request with a
+// token from ts. Unlike oauth2.NewClient, it doesn't cache the first token,
+// which would pin a RoundRobin to its first static token.
+func NewClient(ts oauth2.TokenSource) *http.Client {
+	return &http.Client{Transport: &oauth2.Transport{Source: ts}}
+}
+
+// RoundRobin returns a TokenSource that returns a token from each of creds in
+// turn, spreading requests across their rate limits. If a credential fails to
+// produce a token, the next one is tried. Use it with NewClient.
+func RoundRobin(creds []Credential) oauth2.TokenSource {
+	return &roundRobin{creds: creds}
+}
+
+type roundRobin struct {
+	mu    sync.Mutex
+	creds []Credential
+	next  int
+}
+
+func (rr *roundRobin) Token() (*oauth2.Token, error) {
+	rr.mu.Lock()
+	start := rr.next
+	rr.next++
+	rr.mu.Unlock()
+	var err error
+	for i := range rr.creds {
+		c := rr.creds[(start+i)%len(rr.creds)]
+		var t *oauth2.Token
+		if t, err = c.Token(); err == nil {
+			return t, nil
+		}
+		err = fmt.Errorf("%s: %v", c.Name, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,134 @@
+package githubauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAppInstallation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var minted int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			t.Errorf("malformed JWT %q", jwt)
+			http.Error(w, "malformed JWT", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sig); err != nil {
+			t.Errorf("invalid JWT signature: %v", err)
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c struct {
+			Issuer string `json:"iss"`
+		}
+		if err := json.Unmarshal(claims, &c); err != nil || c.Issuer != "7" {
+			t.Errorf("unexpected JWT claims %s", claims)
+		}
+
+		n := atomic.AddInt32(&minted, 1)
+		expires := time.Now().Add(1 * time.Hour)
+		if n == 1 {
+			expires = time.Now().Add(5 * time.Second) // too close to reuse
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": fmt.Sprintf("ghs_%d", n), "expires_at": expires,
+		})
+	}))
+	defer srv.Close()
+
+	ts := AppInstallation(srv.Client(), srv.URL+"/", 7, 42, key)
+	for i, want := range []string{"ghs_1", "ghs_2", "ghs_2"} {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != want {
+			t.Errorf("token %d is %q, want %q", i, tok.AccessToken, want)
+		}
+	}
+}
+
+func TestRoundRobinClient(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	var creds []Credential
+	for _, tok := range []string{"A", "B", "C"} {
+		creds = append(creds, Credential{Name: tok,
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})})
+	}
+	client := NewClient(RoundRobin(creds))
+	for i := 0; i < 4; i++ {
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"Bearer A", "Bearer B", "Bearer C", "Bearer A"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests were authorized with %q, want %q", got, want)
+	}
+}
+
+func TestParseInstance(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		want *Instance
+	}{
+		{"https://github.com", DotCom},
+		{"https://github.com/", DotCom},
+		{"https://ghe.example.com/", &Instance{Source: "ghe.example.com",
+			WebURL:     "https://ghe.example.com",
+			APIURL:     "https://ghe.example.com/api/v3",
+			GraphQLURL: "https://ghe.example.com/api/graphql"}},
+		{"ghe.example.com", nil},
+		{"https://ghe.example.com/api/v3", nil},
+	} {
+		got, err := ParseInstance(tt.url)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseInstance(%q) = %+v, want error", tt.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseInstance(%q): %v", tt.url, err)
+		} else if *got != *tt.want {
+			t.Errorf("ParseInstance(%q) = %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+}
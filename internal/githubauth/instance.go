@@ -0,0 +1,46 @@
+package githubauth
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// An Instance is github.com or a GitHub Enterprise Server, and its API
+// endpoints. URLs have no trailing slash.
+type Instance struct {
+	// Source is the name of the instance in the key database: "github"
+	// for github.com, or the host name of a GitHub Enterprise Server, which
+	// has its own user IDs.
+	Source string
+
+	WebURL     string // https://github.com or https://HOST
+	APIURL     string // https://api.github.com or https://HOST/api/v3
+	GraphQLURL string // https://api.github.com/graphql or https://HOST/api/graphql
+}
+
+// DotCom is github.com.
+var DotCom = &Instance{
+	Source:     "github",
+	WebURL:     "https://github.com",
+	APIURL:     "https://api.github.com",
+	GraphQLURL: "https://api.github.com/graphql",
+}
+
+// ParseInstance returns the Instance with the given web URL, such as
+// https://github.example.com for a GitHub Enterprise Server.
+func ParseInstance(webURL string) (*Instance, error) {
+	u, err := url.Parse(strings.TrimSuffix(webURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" || u.Path != "" {
+		return nil, fmt.Errorf("invalid GitHub URL %q: want https://HOST", webURL)
+	}
+	if u.Host == "github.com" || u.Host == "www.github.com" {
+		return DotCom, nil
+	}
+	base := u.Scheme + "://" + u.Host
+	return &Instance{Source: u.Host, WebURL: base,
+		APIURL: base + "/api/v3", GraphQLURL: base + "/api/graphql"}, nil
+}
@@ -0,0 +1,154 @@
+// Package keydb defines the SQLite key database contract between cmd/index,
+// which builds it, and the server, which reads it: the schema version, how
+// keys are hashed, and the metadata table describing how the file was built.
+package keydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/ssh"
+)
+
+// SchemaVersion is the version of the tables built by cmd/index.
+//
+//  1. key_userid, users
+//  2. key_userid.firstSeen and lastSeen, key_history, metadata
+const SchemaVersion = 2
+
+// HashScheme names how KeyHash indexes keys.
+const HashScheme = "sha256-authorized-key-16"
+
+// KeyHash returns the index key for pk, SHA-256(authorized_keys line)[:16],
+// where the line is in canonical form, without options or comment.
+func KeyHash(pk ssh.PublicKey) []byte {
+	h := sha256.Sum256(bytes.TrimSpace(ssh.MarshalAuthorizedKey(pk)))
+	return h[:16]
+}
+
+// MetadataQuery creates the metadata table, a set of name and value pairs.
+const MetadataQuery = "CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT);"
+
+// Metadata describes how a key database was built.
+type Metadata struct {
+	SchemaVersion int
+	HashScheme    string
+
+	// BuildTime is when cmd/index last updated the file.
+	BuildTime time.Time
+
+	// CrawledFrom and CrawledUntil are the range of the crawls it was
+	// built from, if known.
+	CrawledFrom, CrawledUntil time.Time
+
+	// Row counts as of BuildTime.
+	Keys, Users, HistoryRanges int64
+}
+
+// Check returns an error if m describes a database the current code can't
+// read correctly.
+func (m *Metadata) Check() error {
+	if m.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("key database has schema version %d, want %d", m.SchemaVersion, SchemaVersion)
+	}
+	if m.HashScheme != HashScheme {
+		return fmt.Errorf("key database uses hash scheme %q, want %q", m.HashScheme, HashScheme)
+	}
+	return nil
+}
+
+// DataAsOf returns when the keys were crawled, or failing that, indexed.
+func (m *Metadata) DataAsOf() time.Time {
+	if !m.CrawledUntil.IsZero() {
+		return m.CrawledUntil
+	}
+	return m.BuildTime
+}
+
+// ReadMetadata reads the metadata table. A database without one predates it,
+// and has a SchemaVersion of zero.
+func ReadMetadata(conn *sqlite.Conn) (*Metadata, error) {
+	m := &Metadata{}
+	var exists bool
+	err := sqlitex.Exec(conn, "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'metadata';",
+		func(stmt *sqlite.Stmt) error {
+			exists = true
+			return nil
+		})
+	if err != nil || !exists {
+		return m, err
+	}
+	err = sqlitex.Exec(conn, "SELECT name, value FROM metadata;", func(stmt *sqlite.Stmt) error {
+		value := stmt.GetText("value")
+		var err error
+		switch stmt.GetText("name") {
+		case "schema_version":
+			m.SchemaVersion, err = strconv.Atoi(value)
+		case "hash_scheme":
+			m.HashScheme = value
+		case "build_time":
+			m.BuildTime, err = parseTime(value)
+		case "crawled_from":
+			m.CrawledFrom, err = parseTime(value)
+		case "crawled_until":
+			m.CrawledUntil, err = parseTime(value)
+		case "keys":
+			m.Keys, err = strconv.ParseInt(value, 10, 64)
+		case "users":
+			m.Users, err = strconv.ParseInt(value, 10, 64)
+		case "history_ranges":
+			m.HistoryRanges, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid metadata %s: %v", stmt.GetText("name"), err)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// WriteMetadata replaces the contents of the metadata table.
+func WriteMetadata(conn *sqlite.Conn, m *Metadata) error {
+	if err := sqlitex.ExecTransient(conn, MetadataQuery, nil); err != nil {
+		return err
+	}
+	if err := sqlitex.Exec(conn, "DELETE FROM metadata;", nil); err != nil {
+		return err
+	}
+	for _, kv := range [][2]string{
+		{"schema_version", strconv.Itoa(m.SchemaVersion)},
+		{"hash_scheme", m.HashScheme},
+		{"build_time", formatTime(m.BuildTime)},
+		{"crawled_from", formatTime(m.CrawledFrom)},
+		{"crawled_until", formatTime(m.CrawledUntil)},
+		{"keys", strconv.FormatInt(m.Keys, 10)},
+		{"users", strconv.FormatInt(m.Users, 10)},
+		{"history_ranges", strconv.FormatInt(m.HistoryRanges, 10)},
+	} {
+		if kv[1] == "" {
+			continue
+		}
+		if err := sqlitex.Exec(conn, "INSERT INTO metadata (name, value) VALUES (?, ?);", nil, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatTime formats t as RFC 3339, for readability with the sqlite3 CLI, or
+// as empty if t is zero, in which case it's not stored.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,50 @@
+package keydb
+
+import (
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+func TestMetadata(t *testing.T) {
+	conn, err := sqlite.OpenConn("file::memory:", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	md, err := ReadMetadata(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.SchemaVersion != 0 || md.Check() == nil {
+		t.Errorf("database without metadata read as %+v", md)
+	}
+
+	want := &Metadata{SchemaVersion: SchemaVersion, HashScheme: HashScheme,
+		BuildTime:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		CrawledUntil: time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC),
+		Keys:         3, Users: 2, HistoryRanges: 1}
+	if err := WriteMetadata(conn, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMetadata(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := got.Check(); err != nil {
+		t.Error(err)
+	}
+	if !got.DataAsOf().Equal(want.CrawledUntil) {
+		t.Errorf("DataAsOf is %v, want the end of the crawl", got.DataAsOf())
+	}
+
+	got.HashScheme = "sha256-raw-16"
+	if got.Check() == nil {
+		t.Errorf("incompatible hash scheme accepted")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
+	"github.com/FiloSottile/whoami.filippo.io/whoami"
+	"github.com/FiloSottile/whoami.filippo.io/whoami/sqlitestore"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dbGeneration = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_generation"})
+
+// ReloadingKeyStore is a whoami.KeyStore serving the SQLite database at a path, which
+// can be atomically replaced with a new file without a restart. New files
+// should be built elsewhere and renamed into place, not modified in place.
+type ReloadingKeyStore struct {
+	path string
+
+	reloadMu sync.Mutex // serializes reloads
+	info     os.FileInfo
+	gen      int
+
+	current atomic.Pointer[dbGen]
+}
+
+// dbGen is a generation of the database. Lookups hold mu for reading, so
+// that the pool is closed only after the in-flight ones finish.
+type dbGen struct {
+	store *sqlitestore.Store
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// OpenReloadingKeyStore opens the database at path. Like sqlitestore.Open,
+// it fails if the database is incompatible.
+func OpenReloadingKeyStore(path string) (*ReloadingKeyStore, error) {
+	s := &ReloadingKeyStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload opens the file at the path again, and if it's compatible, serves it
+// instead of the current one. Otherwise, the current one is kept.
+func (s *ReloadingKeyStore) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	store, err := sqlitestore.Open(s.path)
+	if err != nil {
+		return err
+	}
+	s.info = info
+	s.gen++
+	old := s.current.Swap(&dbGen{store: store})
+
+	md := store.Metadata()
+	setDBMetrics(md)
+	dbGeneration.Set(float64(s.gen))
+	log.Printf("Serving database generation %d with %d keys, built %v...",
+		s.gen, md.Keys, md.BuildTime.Format(time.RFC3339))
+
+	if old != nil {
+		gen := s.gen - 1
+		go func() {
+			old.mu.Lock()
+			defer old.mu.Unlock()
+			old.closed = true
+			if err := old.store.Close(); err != nil {
+				log.Printf("Closing database generation %d: %v", gen, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// changed reports whether the file at the path was replaced or modified
+// since it was last loaded.
+func (s *ReloadingKeyStore) changed() bool {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false // possibly in the middle of being replaced
+	}
+	return !os.SameFile(info, s.info) || !info.ModTime().Equal(s.info.ModTime()) || info.Size() != s.info.Size()
+}
+
+// Watch reloads the database whenever the file changes, checking every
+// interval, until ctx is done.
+func (s *ReloadingKeyStore) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !s.changed() {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Reloading database: %v", err)
+		}
+	}
+}
+
+// acquire returns the current generation, read-locked.
+func (s *ReloadingKeyStore) acquire() *dbGen {
+	for {
+		g := s.current.Load()
+		g.mu.RLock()
+		if !g.closed {
+			return g
+		}
+		// Retired between Load and RLock, a newer one is current.
+		g.mu.RUnlock()
+	}
+}
+
+func (s *ReloadingKeyStore) Lookup(ctx context.Context, keys []ssh.PublicKey) ([]whoami.Match, error) {
+	g := s.acquire()
+	defer g.mu.RUnlock()
+	return g.store.Lookup(ctx, keys)
+}
+
+// Metadata returns how the current database was built.
+func (s *ReloadingKeyStore) Metadata() *keydb.Metadata {
+	return s.current.Load().store.Metadata()
+}
+
+// DataAsOf returns when the keys in the current database were crawled.
+func (s *ReloadingKeyStore) DataAsOf() time.Time {
+	return s.Metadata().DataAsOf()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
+	"github.com/FiloSottile/whoami.filippo.io/whoami"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// writeTestDB writes a key database with matches at path, like cmd/index.
+func writeTestDB(t *testing.T, path string, matches ...whoami.Match) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.SQLITE_OPEN_READWRITE|sqlite.SQLITE_OPEN_CREATE|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, q := range []string{
+		"CREATE TABLE key_userid (keyHash BLOB, source TEXT, userID INTEGER, kind TEXT, firstSeen INTEGER NOT NULL DEFAULT 0, lastSeen INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (keyHash, source, userID, kind)) WITHOUT ROWID;",
+		"CREATE TABLE users (source TEXT, userID INTEGER, login TEXT, name TEXT, updated INTEGER, PRIMARY KEY (source, userID));",
+	} {
+		if err := sqlitex.ExecTransient(conn, q, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range matches {
+		if err := sqlitex.Exec(conn, "INSERT INTO key_userid (keyHash, source, userID, kind) VALUES (?, ?, ?, ?);",
+			nil, keydb.KeyHash(m.Key), m.Source, m.UserID, m.Kind); err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlitex.Exec(conn, "INSERT OR REPLACE INTO users (source, userID, login, updated) VALUES (?, ?, ?, ?);",
+			nil, m.Source, m.UserID, m.Login, time.Now().Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keydb.WriteMetadata(conn, &keydb.Metadata{SchemaVersion: keydb.SchemaVersion,
+		HashScheme: keydb.HashScheme, BuildTime: time.Now(), Keys: int64(len(matches))}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lookupLogin(t *testing.T, s whoami.KeyStore, pk ssh.PublicKey) string {
+	t.Helper()
+	matches, err := s.Lookup(context.Background(), []ssh.PublicKey{pk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0].Login
+}
+
+func TestReloadingKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.db")
+	k := newTestKey(t)
+	writeTestDB(t, path, whoami.Match{Key: k, Source: "github", UserID: 1, Kind: "authentication", Login: "alice"})
+
+	s, err := OpenReloadingKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupLogin(t, s, k); got != "alice" {
+		t.Errorf("generation 1 lookup returned %q, want alice", got)
+	}
+	// Serving the file must not write to it, or it would look changed.
+	if s.changed() {
+		t.Errorf("database changed by opening it")
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if _, err := os.Stat(path + suffix); err == nil {
+			t.Errorf("serving the database created %s", path+suffix)
+		}
+	}
+
+	// Hold on to generation 1, as an in-flight lookup would.
+	g := s.acquire()
+
+	next := filepath.Join(dir, "next.db")
+	writeTestDB(t, next, whoami.Match{Key: k, Source: "github", UserID: 2, Kind: "authentication", Login: "bob"})
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	if !s.changed() {
+		t.Fatal("renamed database not detected as changed")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.changed() {
+		t.Errorf("database changed by reloading it")
+	}
+	if got := lookupLogin(t, s, k); got != "bob" {
+		t.Errorf("generation 2 lookup returned %q, want bob", got)
+	}
+
+	// The retired generation stays usable until released.
+	time.Sleep(10 * time.Millisecond)
+	if g.closed {
+		t.Errorf("generation 1 closed while in use")
+	}
+	if got := lookupLogin(t, g.store, k); got != "alice" {
+		t.Errorf("in-flight generation 1 lookup returned %q, want alice", got)
+	}
+	g.mu.RUnlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.RLock()
+		closed := g.closed
+		g.mu.RUnlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("generation 1 not closed after release")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// An incompatible file is not served.
+	writeTestDB(t, next)
+	conn, err := sqlite.OpenConn(next, sqlite.SQLITE_OPEN_READWRITE|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.Exec(conn, "UPDATE metadata SET value = 'sha256-raw' WHERE name = 'hash_scheme';", nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Errorf("incompatible database was loaded")
+	}
+	if got := lookupLogin(t, s, k); got != "bob" {
+		t.Errorf("lookup after a failed reload returned %q, want bob", got)
+	}
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,16 +9,21 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
-	"crawshaw.io/sqlite/sqlitex"
 	"github.com/google/go-github/v42/github"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 
+	"github.com/FiloSottile/whoami.filippo.io/internal/githubauth"
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
+	"github.com/FiloSottile/whoami.filippo.io/whoami"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -30,6 +33,35 @@ var sshConns = promauto.NewCounterVec(prometheus.CounterOpts{Name: "ssh_connecti
 	[]string{"agent", "x11", "roaming", "keyCount", "identified", "error"})
 var hsErrs = promauto.NewCounter(prometheus.CounterOpts{Name: "handshake_errors_total"})
 
+var (
+	dbInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "keydb_info"},
+		[]string{"schema_version", "hash_scheme"})
+	dbBuildTime    = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_build_timestamp_seconds"})
+	dbCrawledFrom  = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_crawled_from_timestamp_seconds"})
+	dbCrawledUntil = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_crawled_until_timestamp_seconds"})
+	dbKeys         = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_keys"})
+	dbUsers        = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_users"})
+	dbHistory      = promauto.NewGauge(prometheus.GaugeOpts{Name: "keydb_history_ranges"})
+)
+
+// setDBMetrics exports the metadata of the key database being served.
+func setDBMetrics(md *keydb.Metadata) {
+	dbInfo.Reset()
+	dbInfo.WithLabelValues(strconv.Itoa(md.SchemaVersion), md.HashScheme).Set(1)
+	unix := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.Unix())
+	}
+	dbBuildTime.Set(unix(md.BuildTime))
+	dbCrawledFrom.Set(unix(md.CrawledFrom))
+	dbCrawledUntil.Set(unix(md.CrawledUntil))
+	dbKeys.Set(float64(md.Keys))
+	dbUsers.Set(float64(md.Users))
+	dbHistory.Set(float64(md.HistoryRanges))
+}
+
 func main() {
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
@@ -42,23 +74,62 @@ func main() {
 		ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
 	go func() { log.Fatal(httpServer.ListenAndServe()) }()
 
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: os.Getenv("GITHUB_TOKEN")},
-	)
-	tc := oauth2.NewClient(context.Background(), ts)
-	ghClient := github.NewClient(tc)
-	_, _, err := ghClient.Users.Get(context.Background(), "")
-	fatalIfErr(err)
-	log.Println("Connected to GitHub...")
-
-	db, err := sqlitex.Open(os.Getenv("DB_PATH"), 0, 3)
+	// The database is reopened on SIGHUP, and when the file changes.
+	store, err := OpenReloadingKeyStore(os.Getenv("DB_PATH"))
 	fatalIfErr(err)
-	log.Println("Opened database...")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := store.Reload(); err != nil {
+				log.Printf("Reloading database: %v", err)
+			}
+		}
+	}()
+	go store.Watch(context.Background(), 30*time.Second)
 
 	server := &Server{
-		githubClient: ghClient,
-		db:           db,
-		sessionInfo:  make(map[string]sessionInfo),
+		greeter:     &whoami.Greeter{Keys: store},
+		sessionInfo: make(map[string]sessionInfo),
+	}
+
+	// The GitHub API is only a fallback for profiles missing from the
+	// database, or older than PROFILE_MAX_AGE if set. Requests are spread
+	// across all the configured tokens and App installations.
+	// GITHUB_URL selects a GitHub Enterprise Server instead of github.com.
+	gh := githubauth.DotCom
+	if u := os.Getenv("GITHUB_URL"); u != "" {
+		gh, err = githubauth.ParseInstance(u)
+		fatalIfErr(err)
+	}
+	if gh != githubauth.DotCom {
+		whoami.Platforms[gh.Source] = whoami.Platform{Name: "GitHub Enterprise", URL: gh.WebURL + "/"}
+	}
+	creds, err := githubauth.FromEnv(http.DefaultClient, gh.APIURL)
+	fatalIfErr(err)
+	newClient := func(ts oauth2.TokenSource) *github.Client {
+		hc := githubauth.NewClient(ts)
+		if gh == githubauth.DotCom {
+			return github.NewClient(hc)
+		}
+		c, err := github.NewEnterpriseClient(gh.APIURL+"/", gh.WebURL+"/api/uploads/", hc)
+		fatalIfErr(err)
+		return c
+	}
+	if len(creds) > 0 {
+		for _, c := range creds {
+			_, _, err := newClient(c).RateLimits(context.Background())
+			if err != nil {
+				log.Fatalf("GitHub credential %s: %v", c.Name, err)
+			}
+		}
+		server.greeter.GitHubClient = newClient(githubauth.RoundRobin(creds))
+		server.greeter.GitHubSource = gh.Source
+		log.Printf("Connected to GitHub with %d credentials...", len(creds))
+	}
+	if maxAge := os.Getenv("PROFILE_MAX_AGE"); maxAge != "" {
+		server.greeter.ProfileMaxAge, err = time.ParseDuration(maxAge)
+		fatalIfErr(err)
 	}
 	server.sshConfig = &ssh.ServerConfig{
 		KeyboardInteractiveCallback: server.KeyboardInteractiveCallback,
@@ -94,51 +165,6 @@ func fatalIfErr(err error) {
 	}
 }
 
-var termTmpl = template.Must(template.New("termTmpl").Parse(strings.Replace(`
-    +---------------------------------------------------------------------+
-    |                                                                     |
-    |             _o/ Hello {{ .Name }}!
-    |                                                                     |
-    |                                                                     |
-    |  Did you know that ssh sends all your public keys to any server     |
-    |  it tries to authenticate to?                                       |
-    |                                                                     |
-    |  We matched them to the keys of your GitHub account,                |
-    |  @{{ .User }}, which are available via the GraphQL API
-    |  and at https://github.com/{{ .User }}.keys
-    |                                                                     |
-    |  -- Filippo (https://filippo.io)                                    |
-    |                                                                     |
-    |                                                                     |
-    |  P.S. The source of this server is at                               |
-    |  https://github.com/FiloSottile/whoami.filippo.io                   |
-    |                                                                     |
-    +---------------------------------------------------------------------+
-
-`, "\n", "\n\r", -1)))
-
-var failedMsg = []byte(strings.Replace(`
-    +---------------------------------------------------------------------+
-    |                                                                     |
-    |             _o/ Hello!                                              |
-    |                                                                     |
-    |                                                                     |
-    |  Did you know that ssh sends all your public keys to any server     |
-    |  it tries to authenticate to? You can see yours echoed below.       |
-    |                                                                     |
-    |  We tried to use them to lookup your GitHub account,                |
-    |  but got no match :(                                                |
-    |                                                                     |
-    |  -- Filippo (https://filippo.io)                                    |
-    |                                                                     |
-    |                                                                     |
-    |  P.S. The source of this server is at                               |
-    |  https://github.com/FiloSottile/whoami.filippo.io                   |
-    |                                                                     |
-    +---------------------------------------------------------------------+
-
-`, "\n", "\n\r", -1))
-
 var agentMsg = []byte(strings.Replace(`
                       ***** WARNING ***** WARNING *****
 
@@ -187,9 +213,8 @@ type sessionInfo struct {
 }
 
 type Server struct {
-	githubClient *github.Client
-	sshConfig    *ssh.ServerConfig
-	db           *sqlitex.Pool
+	greeter   *whoami.Greeter
+	sshConfig *ssh.ServerConfig
 
 	mu          sync.RWMutex
 	sessionInfo map[string]sessionInfo
@@ -216,13 +241,20 @@ func (s *Server) KeyboardInteractiveCallback(ssh.ConnMetadata, ssh.KeyboardInter
 
 type logEntry struct {
 	Timestamp     string
-	Username      string   `json:",omitempty"`
-	RequestTypes  []string `json:",omitempty"`
-	Error         string   `json:",omitempty"`
-	KeysOffered   []string `json:",omitempty"`
-	GitHubID      int64    `json:",omitempty"`
-	GitHubName    string   `json:",omitempty"`
-	ClientVersion string   `json:",omitempty"`
+	Username      string     `json:",omitempty"`
+	RequestTypes  []string   `json:",omitempty"`
+	Error         string     `json:",omitempty"`
+	KeysOffered   []string   `json:",omitempty"`
+	Matches       []logMatch `json:",omitempty"`
+	ClientVersion string     `json:",omitempty"`
+}
+
+type logMatch struct {
+	Source string
+	UserID int64
+	Login  string `json:",omitempty"`
+	Key    string
+	Kind   string
 }
 
 func (s *Server) Handle(nConn net.Conn) {
@@ -239,7 +271,7 @@ func (s *Server) Handle(nConn net.Conn) {
 		sshConns.With(prometheus.Labels{
 			"keyCount":   fmt.Sprintf("%v", len(le.KeysOffered)),
 			"error":      fmt.Sprintf("%v", le.Error != ""),
-			"identified": fmt.Sprintf("%v", le.GitHubID != 0),
+			"identified": fmt.Sprintf("%v", len(le.Matches) > 0),
 			"agent":      fmt.Sprintf("%v", agentFwd),
 			"x11":        fmt.Sprintf("%v", x11),
 			"roaming":    fmt.Sprintf("%v", roaming),
@@ -327,60 +359,14 @@ func (s *Server) Handle(nConn net.Conn) {
 			channel.Write(roamingMsg)
 		}
 
-		userID, err := s.findUser(si.Keys)
-		if err != nil {
-			le.Error = "findUser failed: " + err.Error()
-			return
-		}
-
-		if userID == 0 {
-			channel.Write(failedMsg)
-			for _, key := range si.Keys {
-				channel.Write(ssh.MarshalAuthorizedKey(key))
-				channel.Write([]byte("\r"))
-			}
-			channel.Write([]byte("\n\r"))
-			return
-		}
-
-		le.GitHubID = userID
-		u, _, err := s.githubClient.Users.GetByID(context.TODO(), userID)
+		matches, err := s.greeter.Greet(context.TODO(), channel, si.Keys)
 		if err != nil {
-			le.Error = "getUserName failed: " + err.Error()
-			return
+			le.Error = err.Error()
 		}
-
-		login := *u.Login
-		le.GitHubName = *u.Login
-		name := "@" + login
-		if u.Name != nil {
-			name = *u.Name
+		for _, m := range matches {
+			le.Matches = append(le.Matches, logMatch{Source: m.Source, UserID: m.UserID, Login: m.Login,
+				Key: m.Key.Type() + " " + ssh.FingerprintSHA256(m.Key), Kind: m.Kind})
 		}
-
-		termTmpl.Execute(channel, struct{ Name, User string }{name, login})
 		return
 	}
 }
-
-func (s *Server) findUser(keys []ssh.PublicKey) (int64, error) {
-	conn := s.db.Get(context.TODO())
-	if conn == nil {
-		return 0, errors.New("couldn't get db connection")
-	}
-	defer s.db.Put(conn)
-	for _, pk := range keys {
-		key := bytes.TrimSpace(ssh.MarshalAuthorizedKey(pk))
-		keyHash := sha256.Sum256(key)
-		stmt := conn.Prep("SELECT userID FROM key_userid WHERE keyHash = $kh;")
-		stmt.SetBytes("$kh", keyHash[:16])
-		if hasRow, err := stmt.Step(); err != nil {
-			return 0, err
-		} else if !hasRow {
-			continue
-		}
-		defer stmt.Reset()
-		return stmt.GetInt64("userID"), nil
-	}
-
-	return 0, nil
-}
@@ -0,0 +1,213 @@
+package whoami
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/go-github/v42/github"
+	"golang.org/x/crypto/ssh"
+)
+
+// A Greeter greets SSH clients by the accounts matching the keys they offer.
+type Greeter struct {
+	Keys KeyStore
+
+	// GitHubClient, if set, fetches the profiles of accounts on GitHubSource
+	// that are missing from Keys, or older than ProfileMaxAge if it's not
+	// zero. GitHubSource is "github" for github.com.
+	GitHubClient  *github.Client
+	GitHubSource  string
+	ProfileMaxAge time.Duration
+}
+
+var termTmpl = template.Must(template.New("termTmpl").Parse(strings.Replace(`
+    +---------------------------------------------------------------------+
+    |                                                                     |
+    |             _o/ Hello {{ .Name }}!
+    |                                                                     |
+    |                                                                     |
+    |  Did you know that ssh sends all your public keys to any server     |
+    |  it tries to authenticate to?                                       |
+    |                                                                     |
+    |  We matched them to the keys of {{ if gt (len .Accounts) 1 }}these accounts,{{ else }}your account,{{ end }}
+    |  which are publicly available via the API:                          |
+{{- range .Accounts }}
+    |                                                                     |
+    |    @{{ .Login }} on {{ .Platform }} ({{ .URL }}{{ .Login }}.keys)
+{{- range .Keys }}
+    |      matched by {{ .Fingerprint }}
+{{- if .Signing }}{{ if .Authentication }}, also registered as a signing key{{ else }}, registered as a signing key{{ end }}{{ end }}
+{{- if not .Since.IsZero }}, on this account since {{ .Since.Year }}{{ end }}
+{{- end }}
+{{- end }}
+{{- if not .DataAsOf.IsZero }}
+    |                                                                     |
+    |  (Our copy of the keys is from {{ .DataAsOf.Format "January 2, 2006" }}.)
+{{- end }}
+    |                                                                     |
+    |  -- Filippo (https://filippo.io)                                    |
+    |                                                                     |
+    |                                                                     |
+    |  P.S. The source of this server is at                               |
+    |  https://github.com/FiloSottile/whoami.filippo.io                   |
+    |                                                                     |
+    +---------------------------------------------------------------------+
+
+`, "\n", "\n\r", -1)))
+
+var failedMsg = []byte(strings.Replace(`
+    +---------------------------------------------------------------------+
+    |                                                                     |
+    |             _o/ Hello!                                              |
+    |                                                                     |
+    |                                                                     |
+    |  Did you know that ssh sends all your public keys to any server     |
+    |  it tries to authenticate to? You can see yours echoed below.       |
+    |                                                                     |
+    |  We tried to use them to lookup your account on any of the forges   |
+    |  we crawl, but got no match :(                                      |
+    |                                                                     |
+    |  -- Filippo (https://filippo.io)                                    |
+    |                                                                     |
+    |                                                                     |
+    |  P.S. The source of this server is at                               |
+    |  https://github.com/FiloSottile/whoami.filippo.io                   |
+    |                                                                     |
+    +---------------------------------------------------------------------+
+
+`, "\n", "\n\r", -1))
+
+type account struct {
+	Login, Name   string
+	Platform, URL string
+	Keys          []*matchedKey
+}
+
+// matchedKey is an offered key registered on an account, for authentication,
+// as a commit signing key, or both.
+type matchedKey struct {
+	Fingerprint             string
+	Authentication, Signing bool
+	Since                   time.Time // earliest known, or zero
+}
+
+// A Platform is how a source is named in the greeting.
+type Platform struct{ Name, URL string }
+
+// Platforms maps sources to their display name and web URL. Other sources are
+// self-hosted instances named after their host. Add GitHub Enterprise Server
+// instances here.
+var Platforms = map[string]Platform{
+	"github": {"GitHub", "https://github.com/"},
+	"gitlab": {"GitLab", "https://gitlab.com/"},
+}
+
+func newAccount(m Match, login, name string) *account {
+	a := &account{Login: login, Name: "@" + login,
+		Platform: m.Source, URL: "https://" + m.Source + "/"}
+	if name != "" {
+		a.Name = name
+	}
+	if p, ok := Platforms[m.Source]; ok {
+		a.Platform, a.URL = p.Name, p.URL
+	}
+	return a
+}
+
+// Greet writes the greeting for the accounts matching keys to w, or the keys
+// themselves if no account matched. Accounts whose profile can't be found are
+// logged and left out.
+//
+// It returns the matches, with Login set to the login of the account as
+// greeted, or empty if the account was left out.
+func (g *Greeter) Greet(ctx context.Context, w io.Writer, keys []ssh.PublicKey) ([]Match, error) {
+	matches, err := g.Keys.Lookup(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("Lookup failed: %v", err)
+	}
+
+	type accountID struct {
+		source string
+		id     int64
+	}
+	var accounts []*account
+	byID := make(map[accountID]*account)
+	for i, m := range matches {
+		a, ok := byID[accountID{m.Source, m.UserID}]
+		if !ok {
+			login, name, err := g.profile(ctx, m)
+			if err != nil {
+				// Greet the other accounts, if any, rather than nobody.
+				log.Printf("Skipping match: %v", err)
+			} else {
+				a = newAccount(m, login, name)
+				accounts = append(accounts, a)
+			}
+			byID[accountID{m.Source, m.UserID}] = a
+		}
+		if a == nil {
+			continue
+		}
+		matches[i].Login = a.Login
+		fp := m.Key.Type() + " " + ssh.FingerprintSHA256(m.Key)
+		if len(a.Keys) == 0 || a.Keys[len(a.Keys)-1].Fingerprint != fp {
+			a.Keys = append(a.Keys, &matchedKey{Fingerprint: fp})
+		}
+		k := a.Keys[len(a.Keys)-1]
+		if m.Kind == "signing" {
+			k.Signing = true
+		} else {
+			k.Authentication = true
+		}
+		if !m.Since.IsZero() && (k.Since.IsZero() || m.Since.Before(k.Since)) {
+			k.Since = m.Since
+		}
+	}
+
+	if len(accounts) == 0 {
+		w.Write(failedMsg)
+		for _, key := range keys {
+			w.Write(ssh.MarshalAuthorizedKey(key))
+			w.Write([]byte("\r"))
+		}
+		w.Write([]byte("\n\r"))
+		return matches, nil
+	}
+
+	var dataAsOf time.Time
+	if d, ok := g.Keys.(interface{ DataAsOf() time.Time }); ok {
+		dataAsOf = d.DataAsOf()
+	}
+	return matches, termTmpl.Execute(w, struct {
+		Name     string
+		Accounts []*account
+		DataAsOf time.Time
+	}{accounts[0].Name, accounts, dataAsOf})
+}
+
+// profile returns the login and display name of the account in m, from the
+// store if possible, or from the GitHub API if the row is missing or stale
+// and the account is on GitHubSource.
+func (g *Greeter) profile(ctx context.Context, m Match) (login, name string, err error) {
+	stale := m.Login == "" || g.ProfileMaxAge > 0 && time.Since(m.Updated) > g.ProfileMaxAge
+	if !stale || g.GitHubClient == nil || m.Source != g.GitHubSource {
+		if m.Login == "" {
+			return "", "", fmt.Errorf("no profile for %s user %d", m.Source, m.UserID)
+		}
+		return m.Login, m.Name, nil
+	}
+	u, _, err := g.GitHubClient.Users.GetByID(ctx, m.UserID)
+	if err != nil {
+		if m.Login != "" {
+			// A stale profile is better than no greeting.
+			return m.Login, m.Name, nil
+		}
+		return "", "", err
+	}
+	return u.GetLogin(), u.GetName(), nil
+}
@@ -0,0 +1,143 @@
+package whoami
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func fingerprint(pk ssh.PublicKey) string {
+	return pk.Type() + " " + ssh.FingerprintSHA256(pk)
+}
+
+// greet returns the greeting g shows to a client offering keys, with the line
+// endings normalized, and the matches.
+func greet(t *testing.T, g *Greeter, keys ...ssh.PublicKey) (string, []Match) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	matches, err := g.Greet(context.Background(), buf, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ReplaceAll(buf.String(), "\n\r", "\n"), matches
+}
+
+func checkLines(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("greeting is missing %q:\n%s", l, out)
+		}
+	}
+}
+
+func TestGreet(t *testing.T) {
+	Platforms["ghe.example.com"] = Platform{"GitHub Enterprise", "https://ghe.example.com/"}
+	t.Cleanup(func() { delete(Platforms, "ghe.example.com") })
+
+	k1, k2, k3, k4 := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	since := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	store := &MemoryKeyStore{}
+	store.Add(Match{Key: k1, Source: "github", UserID: 1, Kind: "authentication",
+		Login: "alice", Name: "Alice Liddell", Since: since})
+	store.Add(Match{Key: k1, Source: "github", UserID: 1, Kind: "signing",
+		Login: "alice", Name: "Alice Liddell", Since: since.AddDate(2, 0, 0)})
+	store.Add(Match{Key: k2, Source: "github", UserID: 1, Kind: "signing",
+		Login: "alice", Name: "Alice Liddell"})
+	store.Add(Match{Key: k2, Source: "gitlab", UserID: 7, Kind: "authentication", Login: "bob"})
+	store.Add(Match{Key: k3, Source: "ghe.example.com", UserID: 3, Kind: "authentication", Login: "carol"})
+	store.Add(Match{Key: k3, Source: "codeberg.org", UserID: 9, Kind: "authentication", Login: "dave"})
+	g := &Greeter{Keys: store}
+
+	out, matches := greet(t, g, k4, k1, k2, k3)
+	checkLines(t, out,
+		"    |             _o/ Hello Alice Liddell!",
+		"    |  We matched them to the keys of these accounts,",
+		"    |    @alice on GitHub (https://github.com/alice.keys)",
+		"    |      matched by "+fingerprint(k1)+", also registered as a signing key, on this account since 2017",
+		"    |      matched by "+fingerprint(k2)+", registered as a signing key",
+		"    |    @bob on GitLab (https://gitlab.com/bob.keys)",
+		"    |      matched by "+fingerprint(k2),
+		"    |    @carol on GitHub Enterprise (https://ghe.example.com/carol.keys)",
+		"    |    @dave on codeberg.org (https://codeberg.org/dave.keys)",
+		"    |      matched by "+fingerprint(k3),
+	)
+	if strings.Contains(out, fingerprint(k4)) {
+		t.Errorf("greeting mentions the unmatched key:\n%s", out)
+	}
+	if n := strings.Count(out, "@alice on"); n != 1 {
+		t.Errorf("alice is listed %d times, want once", n)
+	}
+	if len(matches) != 6 {
+		t.Errorf("returned %d matches, want 6", len(matches))
+	}
+
+	out, _ = greet(t, g, k3)
+	checkLines(t, out,
+		"    |             _o/ Hello @carol!",
+		"    |  We matched them to the keys of these accounts,",
+	)
+
+	out, _ = greet(t, g, k2)
+	if i, j := strings.Index(out, "@alice"), strings.Index(out, "@bob"); i < 0 || j < i {
+		t.Errorf("accounts are not in lookup order:\n%s", out)
+	}
+
+	out, matches = greet(t, g, k4)
+	if !strings.Contains(out, "but got no match") || !strings.Contains(out, string(ssh.MarshalAuthorizedKey(k4))) {
+		t.Errorf("unexpected greeting for an unknown key:\n%s", out)
+	}
+	if len(matches) != 0 {
+		t.Errorf("returned %d matches for an unknown key", len(matches))
+	}
+
+	// Legacy records can have no profile, and there is no API to ask.
+	store.Add(Match{Key: k4, Source: "github", UserID: 5, Kind: "authentication"})
+	out, matches = greet(t, g, k4)
+	if !strings.Contains(out, "but got no match") {
+		t.Errorf("unexpected greeting for an account with no profile:\n%s", out)
+	}
+	if len(matches) != 1 || matches[0].UserID != 5 || matches[0].Login != "" {
+		t.Errorf("returned matches %+v, want user 5 without a login", matches)
+	}
+	store.Add(Match{Key: k4, Source: "gitlab", UserID: 8, Kind: "authentication", Login: "erin"})
+	out, _ = greet(t, g, k4)
+	checkLines(t, out,
+		"    |             _o/ Hello @erin!",
+		"    |  We matched them to the keys of your account,",
+		"    |      matched by "+fingerprint(k4),
+	)
+	if strings.Contains(out, "Our copy of the keys") {
+		t.Errorf("greeting dates a store without DataAsOf:\n%s", out)
+	}
+
+	g.Keys = datedKeyStore{store, time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}
+	out, _ = greet(t, g, k4)
+	checkLines(t, out, "    |  (Our copy of the keys is from June 1, 2026.)")
+}
+
+type datedKeyStore struct {
+	*MemoryKeyStore
+	asOf time.Time
+}
+
+func (s datedKeyStore) DataAsOf() time.Time { return s.asOf }
@@ -0,0 +1,76 @@
+// Package whoami identifies SSH clients by the public keys they offer, and
+// greets them by the accounts those keys are registered on.
+package whoami
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A KeyStore maps SSH public keys to the accounts they are registered on.
+type KeyStore interface {
+	// Lookup returns every account matching any of keys, in the order the
+	// keys were offered. A key can match more than one account, and more
+	// than one key can match the same account. No matches is not an error.
+	Lookup(ctx context.Context, keys []ssh.PublicKey) ([]Match, error)
+}
+
+// A Match is an offered key found in a KeyStore, along with the profile of
+// the account it is registered on, as of the last crawl.
+type Match struct {
+	Key    ssh.PublicKey
+	Source string // "github", "gitlab", ...
+	UserID int64
+	Kind   string // "authentication" or "signing"
+
+	// Since is when the key was first seen on the account, in the current
+	// uninterrupted range. It's zero if unknown.
+	Since time.Time
+
+	// Login and Name are empty if the store has no profile for UserID.
+	// Updated is when they were last refreshed.
+	Login   string
+	Name    string
+	Updated time.Time
+}
+
+// MemoryKeyStore is a KeyStore that keeps its keys in memory, for tests and
+// small deployments. The zero value is empty and ready to use.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][]Match // by wire encoding of the key
+}
+
+// Add registers m.Key as a key of kind m.Kind of m.UserID on m.Source,
+// replacing any previous profile stored for that account and kind.
+func (s *MemoryKeyStore) Add(m Match) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string][]Match)
+	}
+	k := string(m.Key.Marshal())
+	for i, old := range s.keys[k] {
+		if old.Source == m.Source && old.UserID == m.UserID && old.Kind == m.Kind {
+			s.keys[k][i] = m
+			return
+		}
+	}
+	s.keys[k] = append(s.keys[k], m)
+}
+
+func (s *MemoryKeyStore) Lookup(ctx context.Context, keys []ssh.PublicKey) ([]Match, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []Match
+	for _, pk := range keys {
+		for _, m := range s.keys[string(pk.Marshal())] {
+			m.Key = pk
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
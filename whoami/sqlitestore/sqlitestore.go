@@ -0,0 +1,88 @@
+// Package sqlitestore implements a whoami.KeyStore backed by the SQLite key
+// database built by cmd/index.
+package sqlitestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/FiloSottile/whoami.filippo.io/internal/keydb"
+	"github.com/FiloSottile/whoami.filippo.io/whoami"
+)
+
+// Store is a whoami.KeyStore backed by the key_userid and users tables.
+type Store struct {
+	db       *sqlitex.Pool
+	metadata *keydb.Metadata
+}
+
+// Open opens the database at path read-only, and checks that it was built
+// with a compatible schema and hash scheme. The file is never written, so it
+// can be served while a new one is built and renamed over it.
+func Open(path string) (*Store, error) {
+	db, err := sqlitex.Open(path, sqlite.SQLITE_OPEN_READONLY|sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX, 3)
+	if err != nil {
+		return nil, err
+	}
+	conn := db.Get(context.Background())
+	md, err := keydb.ReadMetadata(conn)
+	db.Put(conn)
+	if err == nil {
+		err = md.Check()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &Store{db: db, metadata: md}, nil
+}
+
+// Metadata returns how the database was built.
+func (s *Store) Metadata() *keydb.Metadata {
+	return s.metadata
+}
+
+// DataAsOf returns when the keys were crawled, for the greeting.
+func (s *Store) DataAsOf() time.Time {
+	return s.metadata.DataAsOf()
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Lookup(ctx context.Context, keys []ssh.PublicKey) ([]whoami.Match, error) {
+	conn := s.db.Get(ctx)
+	if conn == nil {
+		return nil, errors.New("couldn't get db connection")
+	}
+	defer s.db.Put(conn)
+	var matches []whoami.Match
+	for _, pk := range keys {
+		err := sqlitex.Exec(conn, `SELECT source, userID, kind, firstSeen, login, name, updated FROM key_userid
+			LEFT JOIN users USING (source, userID) WHERE keyHash = ? ORDER BY source, userID, kind;`,
+			func(stmt *sqlite.Stmt) error {
+				m := whoami.Match{Key: pk, Source: stmt.GetText("source"), UserID: stmt.GetInt64("userID"),
+					Kind:  stmt.GetText("kind"),
+					Login: stmt.GetText("login"), Name: stmt.GetText("name")}
+				if firstSeen := stmt.GetInt64("firstSeen"); firstSeen != 0 {
+					m.Since = time.Unix(firstSeen, 0)
+				}
+				if updated := stmt.GetInt64("updated"); updated != 0 {
+					m.Updated = time.Unix(updated, 0)
+				}
+				matches = append(matches, m)
+				return nil
+			}, keydb.KeyHash(pk))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}